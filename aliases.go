@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// builtinAliases maps variant spellings and imprints of publishers, keyed
+// by their normalized name, to a canonical publisher name.
+var builtinAliases = map[string]string{
+	"yen press":                 "Yen Press",
+	"yen on":                    "Yen Press",
+	"yen press / yen on":        "Yen Press",
+	"jy":                        "Yen Press",
+	"seven seas":                "Seven Seas",
+	"seven seas entertainment":  "Seven Seas",
+	"ghost ship":                "Seven Seas",
+	"airship":                   "Seven Seas",
+	"viz":                       "VIZ Media",
+	"viz media":                 "VIZ Media",
+	"viz media llc":             "VIZ Media",
+	"kodansha comics":           "Kodansha USA",
+	"kodansha usa":              "Kodansha USA",
+	"kodansha usa publishing":   "Kodansha USA",
+	"vertical":                  "Kodansha USA",
+	"vertical comics":           "Kodansha USA",
+	"square enix":               "Square Enix",
+	"square enix manga & books": "Square Enix",
+	"square enix manga":         "Square Enix",
+	"j-novel club":              "J-Novel Club",
+	"j-novel heart":             "J-Novel Club",
+	"tokyopop":                  "TOKYOPOP",
+	"dark horse":                "Dark Horse",
+	"dark horse comics":         "Dark Horse",
+	"dark horse manga":          "Dark Horse",
+	"one peace books":           "One Peace Books",
+	"denpa":                     "Denpa",
+	"denpa books":               "Denpa",
+}
+
+var formatSuffix = regexp.MustCompile(`(?i)\s*\((?:digital|print|e-?book|ebook)\)$`)
+
+// aliasTable maps normalized publisher names to canonical names.
+type aliasTable map[string]string
+
+// newAliasTable returns a table of the built-in aliases.
+func newAliasTable() aliasTable {
+	at := make(aliasTable, len(builtinAliases))
+	for k, v := range builtinAliases {
+		at[k] = v
+	}
+	return at
+}
+
+func normalizePublisher(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// canonical returns the canonical name of the publisher name. Format
+// suffixes such as "(Digital)" are dropped, and names without an alias
+// are returned as is.
+func (at aliasTable) canonical(name string) string {
+	if c, ok := at[normalizePublisher(name)]; ok {
+		return c
+	}
+
+	stripped := strings.TrimSpace(formatSuffix.ReplaceAllString(name, ""))
+	if c, ok := at[normalizePublisher(stripped)]; ok {
+		return c
+	}
+
+	return stripped
+}
+
+// load adds the aliases in the CSV read from r, with rows of
+// alias,canonical, overriding any existing aliases.
+func (at aliasTable) load(r io.Reader) error {
+	csvr := csv.NewReader(r)
+	recs, err := csvr.ReadAll()
+	if err != nil {
+		return fmt.Errorf("error reading aliases CSV: %w", err)
+	}
+
+	for _, rec := range recs {
+		if len(rec) != 2 {
+			return fmt.Errorf("expected alias row of length 2, got %d", len(rec))
+		}
+		at[normalizePublisher(rec[0])] = strings.TrimSpace(rec[1])
+	}
+
+	return nil
+}
+
+// loadAliasTable returns the built-in aliases plus those in the CSV file
+// at path, if path isn't empty.
+func loadAliasTable(path string) (aliasTable, error) {
+	at := newAliasTable()
+	if path == "" {
+		return at, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening aliases: %w", err)
+	}
+	defer f.Close()
+
+	err = at.load(f)
+	if err != nil {
+		return nil, err
+	}
+	return at, nil
+}
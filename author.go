@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+)
+
+const (
+	muAuthorSearchEndpoint = "https://api.mangaupdates.com/v1/authors/search"
+	muAuthorSeriesEndpoint = "https://api.mangaupdates.com/v1/authors/%d/series"
+)
+
+type muAuthorSearch struct {
+	TotalHits int `json:"total_hits"`
+	Page      int `json:"page"`
+	PerPage   int `json:"per_page"`
+	Results   []struct {
+		Record struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		} `json:"record"`
+		HitName string `json:"hit_name"`
+	} `json:"results"`
+}
+
+// muSeriesList is a list of the series of an author or publisher.
+type muSeriesList struct {
+	SeriesList []struct {
+		SeriesID int64  `json:"series_id"`
+		Title    string `json:"title"`
+		URL      string `json:"url"`
+		Year     string `json:"year"`
+	} `json:"series_list"`
+}
+
+func postMuAuthorSearch(name string) (string, int64, error) {
+	v := url.Values{}
+	v.Add("search", name)
+
+	mas, err := post[muAuthorSearch](muAuthorSearchEndpoint, v)
+	if err != nil {
+		return "", -1, fmt.Errorf("error getting Manga Updates author search endpoint: %w", err)
+	}
+
+	if len(mas.Results) < 1 {
+		return "", -1, errNotEnoughResults
+	}
+
+	return mas.Results[0].Record.Name, mas.Results[0].Record.ID, nil
+}
+
+func getMuAuthorSeries(id int64) (*muSeriesList, error) {
+	// the author series endpoint takes its options as a JSON body
+	body := map[string]string{"orderby": "title"}
+
+	resp, err := postJSON[muSeriesList](fmt.Sprintf(muAuthorSeriesEndpoint, id), body)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving author series: %w", err)
+	}
+
+	return &resp, nil
+}
+
+// listAuthor writes every series of the MangaUpdates author with id, or
+// the first author found searching for name if id is 0, with their
+// publishers and licensing according to o. If titlesOnly is true just the
+// series titles are written instead, one per CSV row, ready for the
+// covers command.
+func listAuthor(ctx context.Context, name string, id int64, w io.WriteCloser, format string, titlesOnly bool, o lookupOpts) (err error) {
+	if id == 0 {
+		err = o.limiter.wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		found, foundID, err := postMuAuthorSearch(name)
+		if err != nil {
+			return fmt.Errorf("error searching author %q: %w", name, err)
+		}
+		log.Printf("found author %q! id: %d", found, foundID)
+		id = foundID
+	}
+
+	err = o.limiter.wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	as, err := getMuAuthorSeries(id)
+	if err != nil {
+		return fmt.Errorf("error getting series of author %d: %w", id, err)
+	}
+	log.Printf("author %d has %d series", id, len(as.SeriesList))
+
+	return writeSeriesList(ctx, as, w, format, titlesOnly, o)
+}
+
+// writeSeriesList writes every series in sl with their publishers and
+// licensing according to o, or just their titles if titlesOnly is true.
+func writeSeriesList(ctx context.Context, sl *muSeriesList, w io.WriteCloser, format string, titlesOnly bool, o lookupOpts) (err error) {
+	if titlesOnly {
+		defer w.Close()
+
+		csvw := csv.NewWriter(w)
+		for _, s := range sl.SeriesList {
+			err = csvw.Write([]string{s.Title})
+			if err != nil {
+				return fmt.Errorf("error writing CSV row: %w", err)
+			}
+		}
+
+		csvw.Flush()
+		err = csvw.Error()
+		if err != nil {
+			return fmt.Errorf("error flushing csv writer: %w", err)
+		}
+		return nil
+	}
+
+	rw, err := newResultWriter(w, format, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := rw.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	for _, s := range sl.SeriesList {
+		err = o.limiter.wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		series, err := getmuSeries(s.SeriesID)
+		if err != nil {
+			return fmt.Errorf("error getting manga %q with id %d: %w", s.Title, s.SeriesID, err)
+		}
+
+		res := result{Title: s.Title, SeriesID: s.SeriesID}
+		res.matchResult(series.Title)
+		res.seriesResult(series, o)
+
+		err = rw.Write(res)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// bundleStdout is the -bundle destination for a tar stream on stdout.
+const bundleStdout = "-"
+
+// writeBundle writes every file under dir into a single archive at dest,
+// with paths relative to dir. dest is a zip file if it ends in .zip, a tar
+// stream on stdout if it is "-" and a tar file otherwise.
+func writeBundle(dir, dest string) (err error) {
+	var w io.Writer
+	if dest == bundleStdout {
+		w = os.Stdout
+	} else {
+		var f *os.File
+		f, err = os.Create(dest)
+		if err != nil {
+			return fmt.Errorf("error creating bundle %q: %w", dest, err)
+		}
+		defer func() {
+			cerr := f.Close()
+			if err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(dest)
+			}
+		}()
+		w = f
+	}
+
+	bw := bufio.NewWriter(w)
+
+	if strings.EqualFold(filepath.Ext(dest), ".zip") {
+		err = writeZipBundle(bw, dir)
+	} else {
+		err = writeTarBundle(bw, dir)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing bundle %q: %w", dest, err)
+	}
+
+	return bw.Flush()
+}
+
+func writeZipBundle(w io.Writer, dir string) error {
+	zw := zip.NewWriter(w)
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		// covers are already compressed
+		hdr.Method = zip.Store
+
+		zf, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		return copyFile(zf, p)
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func writeTarBundle(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil || d.IsDir() {
+			return err
+		}
+		return copyFile(tw, p)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func copyFile(w io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+)
+
+const (
+	muPublisherSearchEndpoint = "https://api.mangaupdates.com/v1/publishers/search"
+	muPublisherSeriesEndpoint = "https://api.mangaupdates.com/v1/publishers/%d/series"
+)
+
+type muPublisherSearch struct {
+	TotalHits int `json:"total_hits"`
+	Page      int `json:"page"`
+	PerPage   int `json:"per_page"`
+	Results   []struct {
+		Record struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		} `json:"record"`
+		HitName string `json:"hit_name"`
+	} `json:"results"`
+}
+
+func postMuPublisherSearch(name string) (string, int64, error) {
+	v := url.Values{}
+	v.Add("search", name)
+
+	mps, err := post[muPublisherSearch](muPublisherSearchEndpoint, v)
+	if err != nil {
+		return "", -1, fmt.Errorf("error getting Manga Updates publisher search endpoint: %w", err)
+	}
+
+	if len(mps.Results) < 1 {
+		return "", -1, errNotEnoughResults
+	}
+
+	return mps.Results[0].Record.Name, mps.Results[0].Record.ID, nil
+}
+
+func getMuPublisherSeries(id int64) (*muSeriesList, error) {
+	resp, err := get[muSeriesList](fmt.Sprintf(muPublisherSeriesEndpoint, id))
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving publisher series: %w", err)
+	}
+
+	return &resp, nil
+}
+
+// page returns the page, counting from 1, of perPage series of sl.
+func (sl *muSeriesList) page(page, perPage int) *muSeriesList {
+	start := (page - 1) * perPage
+	if start > len(sl.SeriesList) {
+		start = len(sl.SeriesList)
+	}
+	end := start + perPage
+	if end > len(sl.SeriesList) {
+		end = len(sl.SeriesList)
+	}
+
+	return &muSeriesList{SeriesList: sl.SeriesList[start:end]}
+}
+
+// listPublisher writes a page of the series of the MangaUpdates publisher
+// with id, or the first publisher found searching for name if id is 0,
+// in the same format as the publishers command. The ids are those listed
+// as publisher_id by MangaUpdates series.
+func listPublisher(ctx context.Context, name string, id int64, page, perPage int, w io.WriteCloser, format string, titlesOnly bool, o lookupOpts) error {
+	if id == 0 {
+		err := o.limiter.wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		found, foundID, err := postMuPublisherSearch(name)
+		if err != nil {
+			return fmt.Errorf("error searching publisher %q: %w", name, err)
+		}
+		log.Printf("found publisher %q! id: %d", found, foundID)
+		id = foundID
+	}
+
+	err := o.limiter.wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	ps, err := getMuPublisherSeries(id)
+	if err != nil {
+		return fmt.Errorf("error getting series of publisher %d: %w", id, err)
+	}
+
+	pages := (len(ps.SeriesList) + perPage - 1) / perPage
+	log.Printf("publisher %d has %d series, writing page %d of %d", id, len(ps.SeriesList), page, pages)
+
+	return writeSeriesList(ctx, ps.page(page, perPage), w, format, titlesOnly, o)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// checkpoint is a journal of the titles finished by a publishers run, one
+// JSON array of the results of an input title per line, so an interrupted
+// run can be resumed. A nil *checkpoint records nothing.
+type checkpoint struct {
+	f    *os.File
+	enc  *json.Encoder
+	done map[string][]result
+}
+
+// openCheckpoint opens the checkpoint at path. If resume is true the
+// results already in it are loaded and new ones appended, otherwise it
+// is truncated.
+func openCheckpoint(path string, resume bool) (*checkpoint, error) {
+	cp := &checkpoint{done: make(map[string][]result)}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	cutShort := false
+	if resume {
+		bs, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading checkpoint %q: %w", path, err)
+		}
+
+		for _, line := range bytes.Split(bs, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var results []result
+			err := json.Unmarshal(line, &results)
+			if err != nil || len(results) < 1 {
+				// most likely a line cut short when the last run was killed
+				log.Printf("skipping malformed checkpoint line: %v", err)
+				continue
+			}
+			cp.done[results[0].Title] = results
+		}
+		log.Printf("resuming with %d titles already done", len(cp.done))
+
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		cutShort = len(bs) > 0 && bs[len(bs)-1] != '\n'
+	}
+
+	f, err := os.OpenFile(path, flags, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("error opening checkpoint %q: %w", path, err)
+	}
+	cp.f = f
+	cp.enc = json.NewEncoder(f)
+
+	if cutShort {
+		// start new results on a fresh line after the cut short one
+		_, err = f.Write([]byte("\n"))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error writing checkpoint %q: %w", path, err)
+		}
+	}
+
+	return cp, nil
+}
+
+// lookup returns the results recorded for the input title, if any.
+func (cp *checkpoint) lookup(title string) ([]result, bool) {
+	if cp == nil {
+		return nil, false
+	}
+	results, ok := cp.done[title]
+	return results, ok
+}
+
+// record appends the results of an input title to the checkpoint. The
+// first result must be that of the input title itself.
+func (cp *checkpoint) record(results []result) error {
+	if cp == nil || len(results) < 1 {
+		return nil
+	}
+
+	err := cp.enc.Encode(results)
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+	cp.done[results[0].Title] = results
+
+	return nil
+}
+
+func (cp *checkpoint) Close() error {
+	if cp == nil {
+		return nil
+	}
+	return cp.f.Close()
+}
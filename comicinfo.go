@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// comicInfo is the ComicInfo.xml metadata read from CBZ files by comic
+// readers and library servers such as Komga and Kavita.
+type comicInfo struct {
+	XMLName     xml.Name `xml:"ComicInfo"`
+	XSI         string   `xml:"xmlns:xsi,attr"`
+	XSD         string   `xml:"xmlns:xsd,attr"`
+	Title       string   `xml:"Title,omitempty"`
+	Series      string   `xml:"Series"`
+	Number      string   `xml:"Number,omitempty"`
+	Count       int      `xml:"Count,omitempty"`
+	Volume      int      `xml:"Volume,omitempty"`
+	Summary     string   `xml:"Summary,omitempty"`
+	Year        int      `xml:"Year,omitempty"`
+	Writer      string   `xml:"Writer,omitempty"`
+	Penciller   string   `xml:"Penciller,omitempty"`
+	Genre       string   `xml:"Genre,omitempty"`
+	Tags        string   `xml:"Tags,omitempty"`
+	Web         string   `xml:"Web,omitempty"`
+	LanguageISO string   `xml:"LanguageISO,omitempty"`
+	Manga       string   `xml:"Manga,omitempty"`
+	AgeRating   string   `xml:"AgeRating,omitempty"`
+}
+
+// newComicInfo returns the series metadata of m, without any volume.
+func newComicInfo(m *mangaResp) *comicInfo {
+	a := m.Data.Attributes
+	ci := &comicInfo{
+		XSI:     "http://www.w3.org/2001/XMLSchema-instance",
+		XSD:     "http://www.w3.org/2001/XMLSchema",
+		Series:  a.Title.En,
+		Summary: a.Description.En,
+		Year:    a.Year,
+		Web:     fmt.Sprintf(mangaWebFmt, m.Data.ID),
+	}
+
+	// manga read right to left, manhwa and manhua left to right
+	switch a.OriginalLanguage {
+	case "ja":
+		ci.Manga = "YesAndRightToLeft"
+	case "ko", "zh", "zh-hk":
+		ci.Manga = "Yes"
+	}
+
+	ci.Count, _ = strconv.Atoi(a.LastVolume)
+
+	switch a.ContentRating {
+	case "safe":
+		ci.AgeRating = "Everyone"
+	case "suggestive":
+		ci.AgeRating = "Teen"
+	case "erotica":
+		ci.AgeRating = "Mature 17+"
+	case "pornographic":
+		ci.AgeRating = "Adults Only 18+"
+	}
+
+	var genres, tags []string
+	for _, t := range a.Tags {
+		if t.Attributes.Group == "genre" {
+			genres = append(genres, t.Attributes.Name.En)
+		} else {
+			tags = append(tags, t.Attributes.Name.En)
+		}
+	}
+	ci.Genre = strings.Join(genres, ", ")
+	ci.Tags = strings.Join(tags, ", ")
+
+	var writers, pencillers []string
+	for _, r := range m.Data.Relationships {
+		switch r.Type {
+		case "author":
+			writers = append(writers, r.Attributes.Name)
+		case "artist":
+			pencillers = append(pencillers, r.Attributes.Name)
+		}
+	}
+	ci.Writer = strings.Join(writers, ", ")
+	ci.Penciller = strings.Join(pencillers, ", ")
+
+	return ci
+}
+
+// forCover returns a copy of ci for the volume and locale of c. Volume
+// only takes whole numbers, so the volume as MangaDex has it, such as
+// 10.5, goes in Number.
+func (ci *comicInfo) forCover(c cover) *comicInfo {
+	vci := *ci
+	vci.Number = c.Volume
+	vci.Volume, _ = strconv.Atoi(c.Volume)
+	vci.LanguageISO = c.Locale
+	if c.Volume != "" {
+		vci.Title = fmt.Sprintf("Volume %s", c.Volume)
+	}
+	return &vci
+}
+
+func (ci *comicInfo) marshal() ([]byte, error) {
+	bs, err := xml.MarshalIndent(ci, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling ComicInfo.xml: %w", err)
+	}
+	return append([]byte(xml.Header), bs...), nil
+}
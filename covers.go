@@ -2,7 +2,6 @@ package main
 
 import (
 	"archive/zip"
-	"bufio"
 	"context"
 	"encoding/csv"
 	"errors"
@@ -14,16 +13,19 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kipukun/shmanga/group"
 )
 
 const (
-	coverEndpointFmt  = "https://api.mangadex.org/cover?limit=100&order[volume]=asc&manga[]=%s"
+	coverEndpointFmt  = "https://api.mangadex.org/cover?limit=%d&offset=%d&order[volume]=asc&manga[]=%s"
+	coverPageLimit    = 100
 	searchEndpointFmt = "https://api.mangadex.org/manga?title=%s"
-	mangaEndpoint     = "https://api.mangadex.org/manga/%s"
+	mangaEndpoint     = "https://api.mangadex.org/manga/%s?includes[]=author&includes[]=artist"
 	coversImgFmt      = "https://uploads.mangadex.org/covers/%s/%s"
+	mangaWebFmt       = "https://mangadex.org/title/%s"
 )
 
 var (
@@ -136,9 +138,12 @@ type mangaResp struct {
 			AvailableTranslatedLanguages   []interface{} `json:"availableTranslatedLanguages"`
 		} `json:"attributes"`
 		Relationships []struct {
-			ID      string `json:"id"`
-			Type    string `json:"type"`
-			Related string `json:"related,omitempty"`
+			ID         string `json:"id"`
+			Type       string `json:"type"`
+			Related    string `json:"related,omitempty"`
+			Attributes struct {
+				Name string `json:"name"`
+			} `json:"attributes"`
 		} `json:"relationships"`
 	} `json:"data"`
 }
@@ -157,125 +162,451 @@ func searchManga(name string) (title string, uuid string, err error) {
 	return searchResp.Data[0].Attributes.Title.En, searchResp.Data[0].ID, nil
 }
 
-func getCovers(uuid string) (map[string]string, error) {
+// cover is a single cover of a manga on MangaDex.
+type cover struct {
+	ID          string
+	Volume      string
+	FileName    string
+	Locale      string
+	Description string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Version     int
+}
+
+// getCovers returns the covers of the manga with uuid, paging through
+// every cover MangaDex has.
+func getCovers(uuid string) ([]cover, error) {
 	enc := url.QueryEscape(uuid)
-	cr, err := get[coversResp](fmt.Sprintf(coverEndpointFmt, enc))
-	if err != nil {
-		return nil, err
-	}
+	var covers []cover
+
+	for offset := 0; ; {
+		cr, err := get[coversResp](fmt.Sprintf(coverEndpointFmt, coverPageLimit, offset, enc))
+		if err != nil {
+			return nil, err
+		}
 
-	covers := make(map[string]string)
+		for _, d := range cr.Data {
+			covers = append(covers, cover{
+				ID:          d.ID,
+				Volume:      d.Attributes.Volume,
+				FileName:    d.Attributes.FileName,
+				Locale:      d.Attributes.Locale,
+				Description: d.Attributes.Description,
+				CreatedAt:   d.Attributes.CreatedAt,
+				UpdatedAt:   d.Attributes.UpdatedAt,
+				Version:     d.Attributes.Version,
+			})
+		}
 
-	for _, link := range cr.Data {
-		covers[link.Attributes.Volume] = link.Attributes.FileName
+		offset += len(cr.Data)
+		if len(cr.Data) == 0 || offset >= cr.Total {
+			break
+		}
 	}
 
 	return covers, nil
 }
 
-func getMangaTitleById(uuid string) (string, error) {
-	resp, err := get[mangaResp](fmt.Sprintf(mangaEndpoint, uuid))
-	if err != nil {
-		return "", err
+// coverOpts configures which covers are downloaded and how.
+type coverOpts struct {
+	// locales are the preferred cover locales, most preferred first.
+	locales []string
+	// allLocales keeps the cover of every locale of a volume.
+	allLocales bool
+	// archive is the kind of file each cover is written as.
+	archive string
+	// size is the cover variant to download.
+	size string
+	// update replaces existing cover files whose cover changed on MangaDex
+	// since they were written, according to the manifest.
+	update bool
+	// backup keeps a replaced cover file with .bak appended.
+	backup bool
+	// names names the series directories and cover files.
+	names *naming
+}
+
+const (
+	sizeOriginal = "original"
+	size512      = "512"
+	size256      = "256"
+)
+
+func checkSize(size string) error {
+	switch size {
+	case sizeOriginal, size512, size256:
+		return nil
 	}
+	return fmt.Errorf("unknown size %q, expected original, 512 or 256", size)
+}
 
-	return resp.Data.Attributes.Title.En, nil
+// coverURL returns the URL of the cover c of the manga with uuid in the
+// given size. MangaDex serves the thumbnails as JPEGs next to the
+// original, e.g. cover.png.512.jpg.
+func coverURL(uuid string, c cover, size string) string {
+	u := fmt.Sprintf(coversImgFmt, uuid, c.FileName)
+	if size != sizeOriginal {
+		u = fmt.Sprintf("%s.%s.jpg", u, size)
+	}
+	return u
 }
 
-func createFile(u, p string) error {
-	split := strings.Split(u, ".")
-	if len(split) != 4 {
-		return fmt.Errorf("malformed url: %q", u)
+const (
+	archiveZip  = "zip"
+	archiveCBZ  = "cbz"
+	archiveNone = "none"
+)
+
+func checkArchive(archive string) error {
+	switch archive {
+	case archiveZip, archiveCBZ, archiveNone:
+		return nil
 	}
+	return fmt.Errorf("unknown archive %q, expected zip, cbz or none", archive)
+}
 
-	ext := split[3]
+// selectCovers picks the covers to download from covers. Unless
+// o.allLocales is set that is a single cover per volume, the one whose
+// locale comes first in o.locales, or else the first listed. With
+// o.allLocales it is the first listed cover of each volume and locale,
+// as MangaDex can have several, which would get the same file name.
+func selectCovers(covers []cover, o coverOpts) []cover {
+	if o.allLocales {
+		var ret []cover
+		seen := make(map[[2]string]bool)
+		for _, c := range covers {
+			k := [2]string{c.Volume, strings.ToLower(c.Locale)}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			ret = append(ret, c)
+		}
+		return ret
+	}
 
-	resp, err := c.Get(u)
-	if err != nil {
-		return err
+	rank := func(c cover) int {
+		for i, l := range o.locales {
+			if strings.EqualFold(l, c.Locale) {
+				return i
+			}
+		}
+		return len(o.locales)
 	}
-	defer resp.Body.Close()
 
-	of, err := os.Create(p)
-	if err != nil {
-		return err
+	var ret []cover
+	byVolume := make(map[string]int)
+	for _, c := range covers {
+		i, ok := byVolume[c.Volume]
+		if !ok {
+			byVolume[c.Volume] = len(ret)
+			ret = append(ret, c)
+			continue
+		}
+		if rank(c) < rank(ret[i]) {
+			ret[i] = c
+		}
 	}
-	defer of.Close()
 
-	zw := zip.NewWriter(bufio.NewWriter(of))
-	zf, err := zw.Create("cover." + ext)
+	return ret
+}
+
+func getManga(uuid string) (*mangaResp, error) {
+	resp, err := get[mangaResp](fmt.Sprintf(mangaEndpoint, url.PathEscape(uuid)))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = io.Copy(zf, resp.Body)
+	return &resp, nil
+}
+
+// existingCover returns the path of the cover already written for the
+// path base, without extension, if any.
+func existingCover(base, archive string) (string, bool) {
+	exts := []string{"." + archive}
+	if archive == archiveNone {
+		exts = exts[:0]
+		for _, ext := range imageExts {
+			exts = append(exts, ext)
+		}
+	}
+
+	for _, ext := range exts {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext, true
+		}
+	}
+	return "", false
+}
+
+// createImage downloads the cover at u to the path base with the
+// extension of its image type, and returns that path. The image is only
+// written once downloaded and verified whole.
+func createImage(ctx context.Context, u, base string) (string, error) {
+	bs, ext, err := fetchImage(ctx, u)
 	if err != nil {
+		return "", err
+	}
+	p := base + ext
+
+	err = writeAtomic(p, func(w io.Writer) error {
+		_, err := w.Write(bs)
 		return err
+	})
+	if err != nil {
+		return "", err
 	}
 
-	err = zw.Close()
+	return p, nil
+}
+
+// createFile downloads the cover at u into a zip at p, along with a
+// ComicInfo.xml if info is not nil. The zip is only written once the
+// cover is downloaded and verified whole.
+func createFile(ctx context.Context, u, p string, info *comicInfo) error {
+	bs, ext, err := fetchImage(ctx, u)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return writeAtomic(p, func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+		zf, err := zw.Create("cover" + ext)
+		if err != nil {
+			return err
+		}
+
+		_, err = zf.Write(bs)
+		if err != nil {
+			return err
+		}
+
+		if info != nil {
+			xbs, err := info.marshal()
+			if err != nil {
+				return err
+			}
+
+			zf, err := zw.Create("ComicInfo.xml")
+			if err != nil {
+				return err
+			}
+
+			_, err = zf.Write(xbs)
+			if err != nil {
+				return err
+			}
+		}
+
+		return zw.Close()
+	})
 }
 
 type job struct {
 	dir, uuid, title string
+	// manga is set when the covers need it for ComicInfo.xml or naming.
+	manga  *mangaResp
+	fields nameFields
+	opts   coverOpts
 }
 
-func createFileFromJob(ctx context.Context, j job) error {
+// newJob returns the job downloading the covers of the manga with uuid
+// into its series directory under dir.
+func newJob(dir, uuid, title string, manga *mangaResp, co coverOpts) (job, error) {
+	f := nameFields{Title: title, MangaID: uuid}
+	if manga != nil {
+		f.Year = manga.Data.Attributes.Year
+	}
+
+	name, err := co.names.dirName(f)
+	if err != nil {
+		return job{}, err
+	}
+
+	return job{
+		dir:    filepath.Join(dir, name),
+		uuid:   uuid,
+		title:  title,
+		manga:  manga,
+		fields: f,
+		opts:   co,
+	}, nil
+}
+
+// needsManga reports whether jobs with co need the manga itself.
+func (co coverOpts) needsManga() bool {
+	return co.archive == archiveCBZ || co.names.year
+}
+
+// createFileFromJob downloads the covers of j and returns the paths of
+// all of its cover files, including ones that already existed.
+func createFileFromJob(ctx context.Context, j job) ([]string, error) {
 	covers, err := getCovers(j.uuid)
 	if err != nil {
-		return fmt.Errorf("error getting covers from mangadex: %w", err)
+		return nil, fmt.Errorf("error getting covers from mangadex: %w", err)
 	}
 
 	err = os.Mkdir(j.dir, 0750)
 	if err != nil && !os.IsExist(err) {
-		return fmt.Errorf("error creating output dir: %w", err)
+		return nil, fmt.Errorf("error creating output dir: %w", err)
+	}
+
+	var info *comicInfo
+	if j.opts.archive == archiveCBZ {
+		info = newComicInfo(j.manga)
+	}
+
+	prev, err := readManifest(j.dir)
+	if err != nil {
+		return nil, err
 	}
 
 	g, ctx := group.WithContext(ctx)
 	g.Limit(5)
 
-	for volume, cover := range covers {
+	var (
+		mu sync.Mutex
+		m  = manifest{MangaID: j.uuid, Title: j.title}
+		// kept are the manifest entries of changed covers whose files
+		// haven't been replaced, which is all of them until a replacement
+		// succeeds, since the group never runs a replacement once canceled
+		kept = make(map[string]manifestEntry)
+	)
+
+	keepEntry := func(e manifestEntry) {
+		mu.Lock()
+		m.Covers = append(m.Covers, e)
+		mu.Unlock()
+	}
+	addEntry := func(c cover, p string) error {
+		e, err := newManifestEntry(c, p)
+		if err != nil {
+			return err
+		}
+		keepEntry(e)
+		return nil
+	}
+
+	for _, cover := range selectCovers(covers, j.opts) {
+		cover := cover
 
-		if volume == "" {
-			volume = "No Volume"
-		} else {
-			volume = fmt.Sprintf("Volume %s", volume)
+		f := j.fields
+		f.Volume, f.Locale, f.CoverID = cover.Volume, cover.Locale, cover.ID
+		name, err := j.opts.names.fileName(f)
+		if err != nil {
+			g.Drain()
+			return nil, err
 		}
 
-		fname := fmt.Sprintf("%s - %s.zip", j.title, volume)
-		p := filepath.Join(j.dir, fname)
+		base := filepath.Join(j.dir, name)
 
-		if _, err := os.Stat(p); err == nil {
-			continue
+		// the existing file to replace, if any
+		var old string
+
+		if p, ok := existingCover(base, j.opts.archive); ok {
+			e, known := prev[filepath.Base(p)]
+			if !known {
+				// written before manifests, so only the age of the file
+				// tells whether the cover changed since
+				e, err = newManifestEntry(cover, p)
+				if err != nil {
+					g.Drain()
+					return nil, err
+				}
+				fi, err := os.Stat(p)
+				if err != nil {
+					g.Drain()
+					return nil, err
+				}
+				if fi.ModTime().Before(cover.UpdatedAt) {
+					// record its version as unknown, so -update replaces it
+					e.Version, e.UpdatedAt = 0, time.Time{}
+				}
+			}
+			if !j.opts.update || !e.changed(cover) {
+				// the file is still what the manifest says it is
+				keepEntry(e)
+				continue
+			}
+			log.Printf("cover %s changed, replacing", p)
+			old = p
+			mu.Lock()
+			kept[old] = e
+			mu.Unlock()
 		}
 
-		u := fmt.Sprintf(coversImgFmt, j.uuid, cover)
+		u := coverURL(j.uuid, cover, j.opts.size)
+
+		var ci *comicInfo
+		if info != nil {
+			ci = info.forCover(cover)
+		}
 
 		g.Do(ctx, func() error {
-			err := createFile(u, p)
+			var (
+				p   string
+				err error
+			)
+			if old != "" && j.opts.backup {
+				err = writeAtomic(old+".bak", func(w io.Writer) error {
+					return copyFile(w, old)
+				})
+				if err != nil {
+					return fmt.Errorf("error backing up %q: %w", old, err)
+				}
+			}
+			if j.opts.archive == archiveNone {
+				p, err = createImage(ctx, u, base)
+			} else {
+				p = base + "." + j.opts.archive
+				err = createFile(ctx, u, p, ci)
+			}
 			if err != nil {
 				return err
 			}
+			if old != "" {
+				mu.Lock()
+				delete(kept, old)
+				mu.Unlock()
+			}
+			if old != "" && old != p {
+				// a raw image replaced by one of another type
+				err = os.Remove(old)
+				if err != nil {
+					return err
+				}
+			}
 			log.Println("created", p)
-			return nil
+			return addEntry(cover, p)
 		})
 
 	}
 
 	err = g.Wait(ctx)
+	g.Drain()
+
+	for _, e := range kept {
+		m.Covers = append(m.Covers, e)
+	}
+
+	// record the covers written so far, even when interrupted
+	merr := m.write(j.dir)
+	if err == nil {
+		err = merr
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	paths := make([]string, 0, len(m.Covers))
+	for _, e := range m.Covers {
+		paths = append(paths, filepath.Join(j.dir, e.Path))
+	}
+	return paths, nil
 }
 
-func createCoversFromIds(ctx context.Context, s string, dir string) error {
+func createCoversFromIds(ctx context.Context, s string, dir string, co coverOpts) error {
 	uuids := strings.Split(s, ",")
 	dir = invalidChars.ReplaceAllString(dir, "_")
 
@@ -288,19 +619,18 @@ func createCoversFromIds(ctx context.Context, s string, dir string) error {
 	g, ctx := group.WithContext(ctx)
 
 	for _, uuid := range uuids {
-		title, err := getMangaTitleById(uuid)
+		manga, err := getManga(uuid)
 		if err != nil {
 			return err
 		}
 
-		j := job{
-			title: title,
-			uuid:  uuid,
-			dir:   filepath.Join(dir, title),
+		j, err := newJob(dir, uuid, manga.Data.Attributes.Title.En, manga, co)
+		if err != nil {
+			return err
 		}
 
 		g.Do(ctx, func() error {
-			err := createFileFromJob(ctx, j)
+			_, err := createFileFromJob(ctx, j)
 			if err != nil {
 				return err
 			}
@@ -309,6 +639,7 @@ func createCoversFromIds(ctx context.Context, s string, dir string) error {
 	}
 
 	err = g.Wait(ctx)
+	g.Drain()
 	if err != nil {
 		return err
 	}
@@ -316,15 +647,75 @@ func createCoversFromIds(ctx context.Context, s string, dir string) error {
 	return nil
 }
 
-func createCoverZips(ctx context.Context, r io.Reader, w io.WriteCloser, dir string) error {
+// coverTitle is a title to download the covers of.
+type coverTitle struct {
+	title string
+	// derivedFrom and relation are set for the related series of an
+	// input title.
+	derivedFrom, relation string
+}
+
+// readCoverTitles reads the input titles from recs, followed by each of
+// their related series if o expands them.
+func readCoverTitles(ctx context.Context, recs [][]string, o lookupOpts) ([]coverTitle, error) {
+	var titles []coverTitle
+	seen := make(map[string]bool)
+
+	o.related.inputs = make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		if len(rec) != 1 {
+			return nil, fmt.Errorf("expected row of length 1, got %d", len(rec))
+		}
+		seen[rec[0]] = true
+		o.related.inputs[strings.ToLower(rec[0])] = true
+	}
+
+	for _, rec := range recs {
+		titles = append(titles, coverTitle{title: rec[0]})
+		if o.related.depth < 1 {
+			continue
+		}
+
+		rels, err := relatedTitles(ctx, rec[0], o)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range rels {
+			if seen[rel.series.Title] {
+				continue
+			}
+			seen[rel.series.Title] = true
+			titles = append(titles, coverTitle{title: rel.series.Title, derivedFrom: rec[0], relation: rel.relation})
+		}
+	}
+
+	return titles, nil
+}
+
+func createCoverZips(ctx context.Context, r io.Reader, w io.WriteCloser, dir, format string, o lookupOpts, co coverOpts) (err error) {
+	rw, err := newResultWriter(w, format, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := rw.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
 	csvr := csv.NewReader(r)
-	csvw := csv.NewWriter(w)
 
 	recs, err := csvr.ReadAll()
 	if err != nil {
 		return fmt.Errorf("error reading csv input: %w", err)
 	}
 
+	titles, err := readCoverTitles(ctx, recs, o)
+	if err != nil {
+		return err
+	}
+
 	dir = invalidChars.ReplaceAllString(dir, "_")
 
 	err = os.Mkdir(dir, 0750)
@@ -336,54 +727,83 @@ func createCoverZips(ctx context.Context, r io.Reader, w io.WriteCloser, dir str
 
 	g, ctx := group.WithContext(ctx)
 
-	for _, rec := range recs {
+	results := make([]result, len(titles))
+	done := make([]bool, len(titles))
 
-		if len(rec) != 1 {
-			return fmt.Errorf("expected row of length 1, got %d", len(rec))
+	// let in-flight downloads finish or roll back, then write whatever
+	// was processed, even when interrupted
+	defer func() {
+		g.Drain()
+
+		var skipped []string
+		for i, res := range results {
+			if !done[i] {
+				skipped = append(skipped, titles[i].title)
+				continue
+			}
+			werr := rw.Write(res)
+			if werr != nil && err == nil {
+				err = werr
+			}
 		}
+		logSummary(len(titles), skipped)
+	}()
 
-		title, uuid, err := searchManga(rec[0])
+	for i, ct := range titles {
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		res := &results[i]
+		res.Title = ct.title
+		res.Match = matchNone
+		res.DerivedFrom = ct.derivedFrom
+		res.Relation = ct.relation
+
+		title, uuid, err := searchManga(ct.title)
 		if err != nil {
 			if errors.Is(err, errNotEnoughResults) {
-				err = csvw.Write([]string{rec[0], ""})
-				if err != nil {
-					return fmt.Errorf("error writing csv: %w", err)
-				}
-				csvw.Flush()
+				res.Reason = "no search results"
+				done[i] = true
 				continue
 			}
 			return fmt.Errorf("error searching manga on mangadex: %w", err)
 		}
 
-		if title != rec[0] {
-			log.Printf("%q != %q, continuing", title, rec[0])
-			err = csvw.Write([]string{rec[0], ""})
-			if err != nil {
-				return fmt.Errorf("error writing csv: %w", err)
-			}
+		res.MangaID = uuid
+		res.URL = fmt.Sprintf(mangaWebFmt, uuid)
+		res.matchResult(title)
+
+		if title != ct.title {
+			log.Printf("%q != %q, continuing", title, ct.title)
+			done[i] = true
 			continue
 		}
 
 		log.Printf("getting covers for: %q\n", title)
 
-		cleanedTitle := invalidChars.ReplaceAllString(rec[0], "_")
-
-		err = os.Mkdir(dir, 0750)
-		if err != nil && !os.IsExist(err) {
-			return fmt.Errorf("error creating output dir: %w", err)
+		var manga *mangaResp
+		if co.needsManga() {
+			manga, err = getManga(uuid)
+			if err != nil {
+				return fmt.Errorf("error getting manga from mangadex: %w", err)
+			}
 		}
 
-		j := job{
-			title: cleanedTitle,
-			dir:   filepath.Join(dir, cleanedTitle),
-			uuid:  uuid,
+		j, err := newJob(dir, uuid, ct.title, manga, co)
+		if err != nil {
+			return err
 		}
 
+		i := i
 		g.Do(ctx, func() error {
-			err := createFileFromJob(ctx, j)
+			paths, err := createFileFromJob(ctx, j)
 			if err != nil {
 				return err
 			}
+			res.Covers = paths
+			done[i] = true
 			return nil
 		})
 	}
@@ -393,11 +813,5 @@ func createCoverZips(ctx context.Context, r io.Reader, w io.WriteCloser, dir str
 		return err
 	}
 
-	csvw.Flush()
-	err = csvw.Error()
-	if err != nil {
-		return fmt.Errorf("error flushing csv writer: %w", err)
-	}
-
 	return nil
 }
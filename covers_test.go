@@ -1,8 +1,25 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCovers(t *testing.T) {
@@ -23,3 +40,568 @@ func TestCovers(t *testing.T) {
 
 	fmt.Println(covers)
 }
+
+func TestSelectCovers(t *testing.T) {
+	covers := []cover{
+		{ID: "1", Volume: "1", Locale: "ko"},
+		{ID: "2", Volume: "1", Locale: "en"},
+		{ID: "3", Volume: "1", Locale: "ja"},
+		{ID: "4", Volume: "2", Locale: "en"},
+		{ID: "5", Volume: "3", Locale: "fr"},
+		{ID: "6", Volume: "1", Locale: "ja"},
+	}
+
+	ids := func(cs []cover) string {
+		var ret string
+		for _, c := range cs {
+			ret += c.ID
+		}
+		return ret
+	}
+
+	tests := []struct {
+		opts coverOpts
+		want string
+	}{
+		{coverOpts{}, "145"},
+		{coverOpts{locales: []string{"ja", "en"}}, "345"},
+		{coverOpts{locales: []string{"EN"}}, "245"},
+		{coverOpts{locales: []string{"ja"}, allLocales: true}, "12345"},
+	}
+
+	for _, tt := range tests {
+		got := ids(selectCovers(covers, tt.opts))
+		if got != tt.want {
+			t.Errorf("selectCovers(%+v) = %s, want %s", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestGetCoversPages(t *testing.T) {
+	const pageSize = 2
+	var (
+		total    int
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cover" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+
+		// five covers, served a smaller page at a time than asked for
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var data []string
+		for i := offset; i < 5 && i < offset+pageSize; i++ {
+			data = append(data, fmt.Sprintf(`{"id": "c%d", "attributes": {"volume": "%d"}}`, i, i))
+		}
+		fmt.Fprintf(w, `{"result": "ok", "data": [%s], "limit": %d, "offset": %d, "total": %d}`,
+			strings.Join(data, ","), pageSize, offset, total)
+	}))
+	defer srv.Close()
+	routeTo(t, srv)
+
+	tests := []struct {
+		total, requests int
+	}{
+		{5, 3},
+		// more covers claimed than there are, ending on an empty page
+		{7, 4},
+	}
+
+	for _, tt := range tests {
+		total, requests = tt.total, 0
+
+		covers, err := getCovers("m1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids string
+		for _, c := range covers {
+			ids += c.ID
+		}
+		if ids != "c0c1c2c3c4" || requests != tt.requests {
+			t.Errorf("total %d: got covers %s in %d requests, want c0c1c2c3c4 in %d", tt.total, ids, requests, tt.requests)
+		}
+	}
+}
+
+func TestCreateFileVerifies(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cover.png", "/thumbnail":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(buf.Bytes())
+		case "/truncated.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(buf.Bytes()[:buf.Len()/2])
+		case "/octet":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(buf.Bytes())
+		case "/untyped":
+			// keep the server from sniffing one
+			w.Header()["Content-Type"] = nil
+			w.Write(buf.Bytes())
+		case "/garbage":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("not an image"))
+		case "/error.png":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>oops</html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	for _, name := range []string{"thumbnail", "octet", "untyped"} {
+		err = createFile(ctx, srv.URL+"/"+name, filepath.Join(dir, name+".zip"), nil)
+		if err != nil {
+			t.Fatalf("createFile(%q): %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"truncated.png", "error.png", "missing.png", "garbage"} {
+		err = createFile(ctx, srv.URL+"/"+name, filepath.Join(dir, name+".zip"), nil)
+		if err == nil {
+			t.Errorf("createFile(%q) succeeded, want error", name)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"octet.zip", "thumbnail.zip", "untyped.zip"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got files %v, want %v", names, want)
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(dir, "thumbnail.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 1 || zr.File[0].Name != "cover.png" {
+		t.Errorf("got zip entries %v, want cover.png", zr.File)
+	}
+}
+
+// rewriteTransport sends every request to the server at url.
+type rewriteTransport struct {
+	url *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.url.Scheme, t.url.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// routeTo sends every request of the client to srv until the test ends.
+func routeTo(t *testing.T, srv *httptest.Server) {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := c.Transport
+	c.Transport = rewriteTransport{u}
+	t.Cleanup(func() { c.Transport = transport })
+}
+
+func TestCreateFileUpdate(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/cover":
+			fmt.Fprintf(w, `{"result": "ok", "total": 1, "data": [{"id": "c1", "attributes": {"volume": "1", "fileName": "c1.png", "locale": "ja", "version": %d, "updatedAt": "2024-01-01T00:00:00Z"}}]}`, version)
+		case strings.HasPrefix(r.URL.Path, "/covers/"):
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(buf.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	routeTo(t, srv)
+
+	names, err := newNaming(defaultNameTemplate, defaultDirTemplate, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	p := filepath.Join(dir, "Title", "Title - Volume 1.zip")
+
+	run := func(ctx context.Context, update bool) error {
+		co := coverOpts{archive: archiveZip, size: sizeOriginal, update: update, backup: update, names: names}
+		j, err := newJob(dir, "m1", "Title", nil, co)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = createFileFromJob(ctx, j)
+		return err
+	}
+	manifestVersion := func() int {
+		m, err := readManifest(filepath.Join(dir, "Title"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, ok := m[filepath.Base(p)]
+		if len(m) != 1 || !ok {
+			t.Fatalf("got manifest %v, want only %q", m, filepath.Base(p))
+		}
+		return e.Version
+	}
+
+	ctx := context.Background()
+	err = run(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := manifestVersion(); v != 1 {
+		t.Errorf("created cover has version %d, want 1", v)
+	}
+
+	// without -update the changed cover is kept as it is
+	version = 2
+	err = run(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := manifestVersion(); v != 1 {
+		t.Errorf("kept cover has version %d, want 1", v)
+	}
+	_, err = os.Stat(p + ".bak")
+	if !os.IsNotExist(err) {
+		t.Errorf("kept cover was backed up: %v", err)
+	}
+
+	err = run(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := manifestVersion(); v != 2 {
+		t.Errorf("updated cover has version %d, want 2", v)
+	}
+	_, err = os.Stat(p + ".bak")
+	if err != nil {
+		t.Errorf("replaced cover was not backed up: %v", err)
+	}
+
+	// an interrupted update keeps the entry of the cover it didn't replace
+	version = 3
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = run(canceled, true)
+	if err == nil {
+		t.Fatal("interrupted update succeeded")
+	}
+	if v := manifestVersion(); v != 2 {
+		t.Errorf("interrupted update left version %d, want 2", v)
+	}
+
+	// a cover written before manifests, and before the cover last
+	// changed, is recorded with an unknown version until -update
+	// replaces it
+	dir = t.TempDir()
+	p = filepath.Join(dir, "Title", "Title - Volume 1.zip")
+	err = os.MkdirAll(filepath.Dir(p), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(p, []byte("old cover"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = os.Chtimes(p, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = run(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := manifestVersion(); v != 0 {
+		t.Errorf("cover from before manifests has version %d, want 0", v)
+	}
+
+	err = run(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := manifestVersion(); v != 3 {
+		t.Errorf("updated cover from before manifests has version %d, want 3", v)
+	}
+	bs, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) == "old cover" {
+		t.Error("cover from before manifests was not replaced")
+	}
+}
+
+func TestImageType(t *testing.T) {
+	tests := []struct {
+		bs          string
+		contentType string
+		want        string
+	}{
+		{"\xff\xd8\xff\xe0rest", "", ".jpg"},
+		{"\x89PNG\r\n\x1a\nrest", "image/jpeg", ".png"},
+		{"GIF89arest", "", ".gif"},
+		{"RIFF\x00\x01\x02\x03WEBPVP8 ", "", ".webp"},
+		{"unknown", "image/webp", ".webp"},
+		{"unknown", "image/jpeg; charset=binary", ".jpg"},
+		{"unknown", "text/html", ""},
+	}
+
+	for _, tt := range tests {
+		got, _ := imageType([]byte(tt.bs), tt.contentType)
+		if got != tt.want {
+			t.Errorf("imageType(%q, %q) = %q, want %q", tt.bs, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestNaming(t *testing.T) {
+	for _, tc := range []struct {
+		width int
+		v     string
+		want  string
+	}{
+		{2, "1", "01"},
+		{2, "10.5", "10.5"},
+		{3, "1.5", "001.5"},
+		{2, "123", "123"},
+		{2, "", ""},
+		{2, "Special", "Special"},
+	} {
+		got := padVolume(tc.width, tc.v)
+		if got != tc.want {
+			t.Errorf("padVolume(%d, %q) = %q, want %q", tc.width, tc.v, got, tc.want)
+		}
+	}
+
+	f := nameFields{Title: "Komi/san", Year: 2016, Volume: "3", Locale: "en", CoverID: "c"}
+	for _, tc := range []struct {
+		name, dir  string
+		allLocales bool
+		file, dirs string
+	}{
+		{defaultNameTemplate, defaultDirTemplate, false, "Komi_san - Volume 3", "Komi_san"},
+		{defaultNameTemplate, defaultDirTemplate, true, "Komi_san - Volume 3 (en)", "Komi_san"},
+		{`{{.Title}} v{{pad 2 .Volume}} {{.Locale}}`, `{{.Title}} ({{.Year}})`, true, "Komi_san v03 en", "Komi_san (2016)"},
+	} {
+		n, err := newNaming(tc.name, tc.dir, tc.allLocales)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := n.fileName(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, err := n.dirName(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file != tc.file || dir != tc.dirs {
+			t.Errorf("%q, %q named %q, %q, want %q, %q", tc.name, tc.dir, file, dir, tc.file, tc.dirs)
+		}
+	}
+
+	for _, tc := range []struct{ name, dir string }{
+		{`{{.Title}`, defaultDirTemplate},
+		{`{{.Title}}`, defaultDirTemplate},
+		{`{{.Series}} {{.Volume}}`, defaultDirTemplate},
+		{defaultNameTemplate, `{{.Title}} {{.Volume}}`},
+		{defaultNameTemplate, ` `},
+	} {
+		_, err := newNaming(tc.name, tc.dir, false)
+		if err == nil {
+			t.Errorf("%q, %q: expected error", tc.name, tc.dir)
+		}
+	}
+}
+
+func TestWriteAtomicMode(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "cover.zip")
+	write := func(w io.Writer) error {
+		_, err := w.Write([]byte("cover"))
+		return err
+	}
+
+	err := writeAtomic(p, write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("new file has mode %v, want 0644", fi.Mode().Perm())
+	}
+
+	err = os.Chmod(p, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeAtomic(p, write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err = os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("replaced file has mode %v, want 0640", fi.Mode().Perm())
+	}
+}
+
+func TestComicInfo(t *testing.T) {
+	tests := []struct {
+		lang, volume string
+		manga        string
+		number       string
+		vol          int
+	}{
+		{"ja", "3", "YesAndRightToLeft", "3", 3},
+		{"ko", "10.5", "Yes", "10.5", 0},
+		{"en", "", "", "", 0},
+	}
+
+	for _, tt := range tests {
+		var m mangaResp
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"data": {"id": "m1", "attributes": {"originalLanguage": %q}}}`, tt.lang)), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ci := newComicInfo(&m).forCover(cover{Volume: tt.volume, Locale: "en"})
+		if ci.Manga != tt.manga || ci.Number != tt.number || ci.Volume != tt.vol {
+			t.Errorf("%s volume %q got Manga %q, Number %q, Volume %d, want %q, %q, %d",
+				tt.lang, tt.volume, ci.Manga, ci.Number, ci.Volume, tt.manga, tt.number, tt.vol)
+		}
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"A/A - Volume 1.zip": "one",
+		"A/manifest.json":    "{}",
+		"B/B - Volume 2.zip": "two",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(p), 0750)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := t.TempDir()
+
+	zp := filepath.Join(out, "bundle.zip")
+	err := writeBundle(dir, zp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(zp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	got := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[f.Name] = string(bs)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("zip bundle has %v, want %v", got, files)
+	}
+
+	tp := filepath.Join(out, "bundle.tar")
+	err = writeBundle(dir, tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := os.Open(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	got = make(map[string]string)
+	tr := tar.NewReader(tf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		bs, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(bs)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("tar bundle has %v, want %v", got, files)
+	}
+
+	// a failed bundle leaves nothing behind
+	fp := filepath.Join(out, "failed.zip")
+	err = writeBundle(filepath.Join(dir, "missing"), fp)
+	if err == nil {
+		t.Fatal("bundling a missing directory succeeded")
+	}
+	_, err = os.Stat(fp)
+	if !os.IsNotExist(err) {
+		t.Errorf("failed bundle left %q behind: %v", fp, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	changeNewlyLicensed    = "newly_licensed"
+	changePublisherAdded   = "publisher_added"
+	changePublisherRemoved = "publisher_removed"
+	changeCompleted        = "completed_changed"
+	changeStatus           = "status_changed"
+)
+
+// change is a difference in a title's licensing between two publishers
+// runs.
+type change struct {
+	Title string `json:"title"`
+	// Change is one of newly_licensed, publisher_added, publisher_removed,
+	// completed_changed or status_changed.
+	Change string `json:"change"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+var changeHeader = []string{"title", "change", "old", "new"}
+
+func (c change) row() []string {
+	return []string{c.Title, c.Change, c.Old, c.New}
+}
+
+func formatBoolPtr(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+// publisherNames returns the set of canonical publisher names of r.
+func publisherNames(r result) map[string]bool {
+	ret := make(map[string]bool)
+	for _, p := range r.Publishers {
+		name := p.Canonical
+		if name == "" {
+			name = p.Name
+		}
+		ret[name] = true
+	}
+	return ret
+}
+
+func sortedKeys(m map[string]bool) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// diffResults compares the results of a previous run, old, to those of
+// the current run, cur, in the order of cur. Titles missing from either
+// run, or not found in either, are skipped, as are fields the previous
+// run didn't record, such as the columns older outputs lack.
+func diffResults(old, cur []result) []change {
+	prev := make(map[string]result, len(old))
+	for _, r := range old {
+		prev[r.Title] = r
+	}
+
+	var ret []change
+	for _, r := range cur {
+		o, ok := prev[r.Title]
+		if !ok || o.Match == matchNone || r.Match == matchNone {
+			continue
+		}
+
+		if o.Licensed != nil && !*o.Licensed && r.Licensed != nil && *r.Licensed {
+			ret = append(ret, change{Title: r.Title, Change: changeNewlyLicensed, Old: formatBoolPtr(o.Licensed), New: "true"})
+		}
+
+		oldPubs, newPubs := publisherNames(o), publisherNames(r)
+		for _, name := range sortedKeys(newPubs) {
+			if !oldPubs[name] {
+				ret = append(ret, change{Title: r.Title, Change: changePublisherAdded, New: name})
+			}
+		}
+		for _, name := range sortedKeys(oldPubs) {
+			if !newPubs[name] {
+				ret = append(ret, change{Title: r.Title, Change: changePublisherRemoved, Old: name})
+			}
+		}
+
+		if o.Completed != nil && formatBoolPtr(o.Completed) != formatBoolPtr(r.Completed) {
+			ret = append(ret, change{Title: r.Title, Change: changeCompleted, Old: formatBoolPtr(o.Completed), New: formatBoolPtr(r.Completed)})
+		}
+
+		if o.Status != "" && o.Status != r.Status {
+			ret = append(ret, change{Title: r.Title, Change: changeStatus, Old: o.Status, New: r.Status})
+		}
+	}
+
+	return ret
+}
+
+func readResultsFile(path string) ([]result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %q: %w", path, err)
+	}
+	defer f.Close()
+
+	results, err := readResults(f, formatOf(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading results from %q: %w", path, err)
+	}
+	return results, nil
+}
+
+// diffFiles writes the changes between the publishers outputs at oldPath
+// and newPath to w in format. The format of each file is guessed from its
+// extension.
+func diffFiles(oldPath, newPath string, w io.WriteCloser, format string) (err error) {
+	old, err := readResultsFile(oldPath)
+	if err != nil {
+		return err
+	}
+
+	cur, err := readResultsFile(newPath)
+	if err != nil {
+		return err
+	}
+
+	cw, err := newRecordWriter[change](w, format, changeHeader)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := cw.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	for _, c := range diffResults(old, cur) {
+		err = cw.Write(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -86,3 +86,9 @@ func (g *Group) Wait(ctx context.Context) error {
 		return nil
 	}
 }
+
+// Drain blocks until all goroutines in the group have returned,
+// for use after Wait returned early on cancellation or error.
+func (g *Group) Drain() {
+	g.wg.Wait()
+}
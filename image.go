@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func download(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Do(req)
+}
+
+// imageExts are the file extensions of the cover image types.
+var imageExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageMagic are the leading bytes of each image type, with '?' matching
+// any byte.
+var imageMagic = []struct {
+	magic, ext string
+}{
+	{"\xff\xd8\xff", ".jpg"},
+	{"\x89PNG\r\n\x1a\n", ".png"},
+	{"GIF87a", ".gif"},
+	{"GIF89a", ".gif"},
+	{"RIFF????WEBP", ".webp"},
+}
+
+// imageType returns the file extension of the image bs, detected from its
+// magic bytes, or else from its content type.
+func imageType(bs []byte, contentType string) (string, bool) {
+outer:
+	for _, m := range imageMagic {
+		if len(bs) < len(m.magic) {
+			continue
+		}
+		for i := 0; i < len(m.magic); i++ {
+			if m.magic[i] != '?' && m.magic[i] != bs[i] {
+				continue outer
+			}
+		}
+		return m.ext, true
+	}
+
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	ext, ok := imageExts[ct]
+	return ext, ok
+}
+
+// fetchImage downloads the image at u, checking the HTTP status and
+// type, and decodes it to make sure it is whole. It returns the
+// image and the file extension of its type.
+func fetchImage(ctx context.Context, u string) ([]byte, string, error) {
+	resp, err := download(ctx, u)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("did not get HTTP 200 for %q, got HTTP %d", u, resp.StatusCode)
+	}
+
+	// hosts don't always give images an image content type, so only
+	// reject the ones that say they're something else, such as an error
+	// page, and leave the rest to the magic bytes
+	contentType := resp.Header.Get("Content-Type")
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err == nil && (strings.HasPrefix(ct, "text/") || ct == "application/json") {
+		return nil, "", fmt.Errorf("%q is not an image, got content type %q", u, contentType)
+	}
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading image %q: %w", u, err)
+	}
+
+	ext, ok := imageType(bs, contentType)
+	if !ok {
+		return nil, "", fmt.Errorf("%q is not a supported image, got content type %q", u, contentType)
+	}
+
+	err = validateImage(bs, ext)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image %q: %w", u, err)
+	}
+
+	return bs, ext, nil
+}
+
+// validateImage decodes bs to check it is a whole image. The standard
+// library has no WebP decoder, so WebP images are only checked by type.
+func validateImage(bs []byte, ext string) error {
+	if ext == ".webp" {
+		return nil
+	}
+
+	_, _, err := image.Decode(bytes.NewReader(bs))
+	return err
+}
+
+// writeAtomic writes the file at p with write, going through a temporary
+// file in the same directory that is renamed into place only once fully
+// written, so p is never left half written.
+func writeAtomic(p string, write func(w io.Writer) error) (err error) {
+	tf, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tf.Close()
+			os.Remove(tf.Name())
+		}
+	}()
+
+	bw := bufio.NewWriter(tf)
+	err = write(bw)
+	if err != nil {
+		return err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	// temporary files are owner only, so give p the mode of the file it
+	// replaces, or the usual one
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(p); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	err = tf.Chmod(mode)
+	if err != nil {
+		return err
+	}
+
+	err = tf.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), p)
+}
@@ -34,36 +34,171 @@ func createIO(in, out string) (io.Reader, io.WriteCloser, error) {
 	return r, w, nil
 }
 
+// interruptContext returns a context canceled by the first interrupt, so
+// commands can drain and save their partial results. A second interrupt
+// exits immediately.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt)
+
+	go func() {
+		<-sigs
+		log.Println("interrupted, finishing up, press Ctrl-C again to exit immediately")
+		cancel()
+		<-sigs
+		log.Println("exiting immediately")
+		os.Exit(130)
+	}()
+
+	return ctx, cancel
+}
+
 func main() {
 	publisherCmd := flag.NewFlagSet("publishers", flag.ExitOnError)
 	publisherFile := publisherCmd.String("f", "", "CSV list of manga titles to search for, leave empty for stdin")
 	publisherOutput := publisherCmd.String("o", "", "location of output file, leave empty for stdout")
+	publisherFormat := publisherCmd.String("format", formatCSV, "output format: csv, json or ndjson")
+	publisherTypes := publisherCmd.String("publisher-type", "English", "publisher types to include, comma separated, e.g. Original,English")
+	publisherGroupBy := publisherCmd.String("group-by", "", "group the output: leave empty for one row per title, or publisher for the titles of each publisher")
+	publisherCheckpoint := publisherCmd.String("checkpoint", "", "location of checkpoint file recording finished titles, defaults to the output file with .checkpoint appended")
+	publisherResume := publisherCmd.Bool("resume", false, "skip the titles already recorded in the checkpoint file")
+	publisherRate := publisherCmd.Float64("rate", defaultMuRate, "max MangaUpdates requests per second")
+	publisherConcurrency := publisherCmd.Int("concurrency", 4, "max titles looked up at once")
+	publisherAliases := publisherCmd.String("aliases", "", "CSV of alias,canonical publisher names to add to the built-in aliases")
+	publisherExpand := publisherCmd.Bool("expand-related", false, "also look up the related series of each title")
+	publisherRelations := publisherCmd.String("relation-types", "", "relation types to expand, comma separated, e.g. Sequel,Spin-Off, leave empty for all")
+	publisherDepth := publisherCmd.Int("depth", 1, "how many relations deep to expand")
 
 	coversCmd := flag.NewFlagSet("covers", flag.ExitOnError)
 	coversFile := coversCmd.String("f", "", "CSV list of manga titles to search for, leave empty for stdin")
 	coversOutput := coversCmd.String("o", "", "location of not found list, leave empty for stdout")
 	coversID := coversCmd.String("ids", "", "download covers for a list of IDs, comma separated")
 	coversDir := coversCmd.String("dir", "", "location to output directories of zip files of covers")
+	coversFormat := coversCmd.String("format", formatCSV, "format of the not found list and summary: csv, json or ndjson")
+	coversLocale := coversCmd.String("locale", "", "preferred cover locales, comma separated, most preferred first, e.g. ja,en")
+	coversAllLocales := coversCmd.Bool("all-locales", false, "download the cover of every locale of a volume, with the locale in the file name")
+	coversArchive := coversCmd.String("archive", archiveZip, "file each cover is written as: zip, cbz with a ComicInfo.xml, or none for the bare image")
+	coversSize := coversCmd.String("size", sizeOriginal, "cover size to download: original, or the 512 or 256 pixel wide thumbnail")
+	coversUpdate := coversCmd.Bool("update", false, "replace existing covers that changed on MangaDex since they were downloaded")
+	coversBackup := coversCmd.Bool("backup", false, "with -update, keep replaced covers with .bak appended")
+	coversNameTemplate := coversCmd.String("name-template", defaultNameTemplate, "template of cover file names, without extension, e.g. {{.Title}} v{{pad 2 .Volume}}")
+	coversDirTemplate := coversCmd.String("dir-template", defaultDirTemplate, "template of series directory names, e.g. {{.Title}} ({{.Year}})")
+	coversBundle := coversCmd.String("bundle", "", "write all covers into one .zip or .tar file, or - for a tar stream on stdout, instead of loose directories")
+	coversExpand := coversCmd.Bool("expand-related", false, "also download the covers of the related series of each title")
+	coversRelations := coversCmd.String("relation-types", "", "relation types to expand, comma separated, e.g. Sequel,Spin-Off, leave empty for all")
+	coversDepth := coversCmd.Int("depth", 1, "how many relations deep to expand")
+
+	metadataCmd := flag.NewFlagSet("metadata", flag.ExitOnError)
+	metadataFile := metadataCmd.String("f", "", "CSV list of manga titles to search for, leave empty for stdin")
+	metadataOutput := metadataCmd.String("o", "", "location of output file, leave empty for stdout")
+	metadataFormat := metadataCmd.String("format", formatCSV, "output format: csv, json or ndjson")
+	metadataColumns := metadataCmd.String("columns", "", "columns to export, comma separated, leave empty for all")
+	metadataRate := metadataCmd.Float64("rate", defaultMuRate, "max MangaUpdates requests per second")
+
+	authorCmd := flag.NewFlagSet("author", flag.ExitOnError)
+	authorName := authorCmd.String("name", "", "name of the author to search for")
+	authorID := authorCmd.Int64("id", 0, "MangaUpdates ID of the author, instead of -name")
+	authorOutput := authorCmd.String("o", "", "location of output file, leave empty for stdout")
+	authorFormat := authorCmd.String("format", formatCSV, "output format: csv, json or ndjson")
+	authorTypes := authorCmd.String("publisher-type", "English", "publisher types to include, comma separated, e.g. Original,English")
+	authorAliases := authorCmd.String("aliases", "", "CSV of alias,canonical publisher names to add to the built-in aliases")
+	authorTitles := authorCmd.Bool("titles", false, "only write the series titles, as input for the covers command")
+
+	catalogCmd := flag.NewFlagSet("publisher", flag.ExitOnError)
+	catalogName := catalogCmd.String("name", "", "name of the publisher to search for")
+	catalogID := catalogCmd.Int64("id", 0, "MangaUpdates ID of the publisher, instead of -name")
+	catalogPage := catalogCmd.Int("page", 1, "page of the catalog to write, counting from 1")
+	catalogPerPage := catalogCmd.Int("per-page", 50, "series per page")
+	catalogOutput := catalogCmd.String("o", "", "location of output file, leave empty for stdout")
+	catalogFormat := catalogCmd.String("format", formatCSV, "output format: csv, json or ndjson")
+	catalogTypes := catalogCmd.String("publisher-type", "English", "publisher types to include, comma separated, e.g. Original,English")
+	catalogAliases := catalogCmd.String("aliases", "", "CSV of alias,canonical publisher names to add to the built-in aliases")
+	catalogTitles := catalogCmd.Bool("titles", false, "only write the series titles, as input for the covers command")
+
+	diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	diffOld := diffCmd.String("old", "", "previous publishers output, as .csv, .json or .ndjson")
+	diffNew := diffCmd.String("new", "", "current publishers output, as .csv, .json or .ndjson")
+	diffOutput := diffCmd.String("o", "", "location of output file, leave empty for stdout")
+	diffFormat := diffCmd.String("format", formatCSV, "output format: csv, json or ndjson")
 
 	if len(os.Args) < 2 {
-		fmt.Println("expected publishers or covers command")
+		fmt.Println("expected publishers, covers, metadata, author, publisher or diff command")
 		os.Exit(1)
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := interruptContext()
 	defer cancel()
 
 	switch os.Args[1] {
 	case "publishers":
 		publisherCmd.Parse(os.Args[2:])
 
+		err := checkFormat(*publisherFormat)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		err = checkGroupBy(*publisherGroupBy)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		types := splitList(*publisherTypes)
+		if len(types) < 1 {
+			log.Fatalln("expected at least one publisher type with -publisher-type")
+			return
+		}
+
+		if *publisherRate <= 0 || *publisherConcurrency < 1 {
+			log.Fatalln("expected positive -rate and -concurrency")
+			return
+		}
+
+		aliases, err := loadAliasTable(*publisherAliases)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		if *publisherCheckpoint == "" && *publisherOutput != "" {
+			*publisherCheckpoint = *publisherOutput + ".checkpoint"
+		}
+		if *publisherResume && *publisherCheckpoint == "" {
+			log.Fatalln("expected checkpoint file with -checkpoint or -o to resume")
+			return
+		}
+
+		var cp *checkpoint
+		if *publisherCheckpoint != "" {
+			cp, err = openCheckpoint(*publisherCheckpoint, *publisherResume)
+			if err != nil {
+				log.Fatalln(err)
+				return
+			}
+			defer cp.Close()
+		}
+
 		r, w, err := createIO(*publisherFile, *publisherOutput)
 		if err != nil {
 			log.Fatalln(err)
 			return
 		}
 
-		err = searchList(ctx, r, w)
+		lim := newLimiter(*publisherRate)
+		defer lim.stop()
+
+		o := lookupOpts{
+			types:   types,
+			aliases: aliases,
+			limiter: lim,
+			related: parseRelatedOpts(*publisherExpand, *publisherRelations, *publisherDepth),
+		}
+
+		err = searchList(ctx, r, w, *publisherFormat, *publisherGroupBy, *publisherConcurrency, o, cp)
 		if err != nil {
 			log.Fatalln(err)
 			return
@@ -72,33 +207,261 @@ func main() {
 	case "covers":
 		coversCmd.Parse(os.Args[2:])
 
-		if *coversDir == "" {
-			log.Fatalln("expected output directory with -dir")
+		if *coversDir == "" && *coversBundle == "" {
+			log.Fatalln("expected output directory with -dir or -bundle")
+			return
+		}
+
+		if *coversBundle == bundleStdout && *coversOutput == "" && *coversID == "" {
+			log.Fatalln("expected not found list location with -o when bundling to stdout")
+			return
+		}
+
+		err := checkFormat(*coversFormat)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		err = checkArchive(*coversArchive)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		if *coversBackup && !*coversUpdate {
+			log.Fatalln("expected -update with -backup")
 			return
 		}
 
+		err = checkSize(*coversSize)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		names, err := newNaming(*coversNameTemplate, *coversDirTemplate, *coversAllLocales)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		co := coverOpts{
+			locales:    splitList(*coversLocale),
+			allLocales: *coversAllLocales,
+			archive:    *coversArchive,
+			size:       *coversSize,
+			update:     *coversUpdate,
+			backup:     *coversBackup,
+			names:      names,
+		}
+
+		dir := *coversDir
+		if dir == "" {
+			dir, err = os.MkdirTemp("", "shmanga-covers-")
+			if err != nil {
+				log.Fatalln("error creating temporary directory:", err)
+				return
+			}
+			defer os.RemoveAll(dir)
+		}
+
 		if *coversID != "" {
-			err := createCoversFromIds(ctx, *coversID, *coversDir)
+			err = createCoversFromIds(ctx, *coversID, dir, co)
 			if err != nil {
+				log.Println("covers so far are in", dir)
 				log.Fatalln("error creating covers from ids:", err)
 				return
 			}
+		} else {
+			r, w, err := createIO(*coversFile, *coversOutput)
+			if err != nil {
+				log.Fatalln("error creating io:", err)
+				return
+			}
+
+			lim := newLimiter(defaultMuRate)
+			defer lim.stop()
+
+			o := lookupOpts{
+				limiter: lim,
+				related: parseRelatedOpts(*coversExpand, *coversRelations, *coversDepth),
+			}
+
+			err = createCoverZips(ctx, r, w, dir, *coversFormat, o, co)
+			if err != nil {
+				log.Println("covers so far are in", dir)
+				log.Fatalln("error creating cover zips from csv:", err)
+				return
+			}
+		}
+
+		if *coversBundle != "" {
+			err = writeBundle(dir, *coversBundle)
+			if err != nil {
+				log.Println("covers are in", dir)
+				log.Fatalln(err)
+				return
+			}
+		}
+	case "metadata":
+		metadataCmd.Parse(os.Args[2:])
+
+		err := checkFormat(*metadataFormat)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		cols, err := parseColumns(*metadataColumns)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		if *metadataRate <= 0 {
+			log.Fatalln("expected positive -rate")
+			return
+		}
+
+		r, w, err := createIO(*metadataFile, *metadataOutput)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		lim := newLimiter(*metadataRate)
+		defer lim.stop()
+
+		err = exportMetadata(ctx, r, w, *metadataFormat, cols, lookupOpts{limiter: lim})
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	case "author":
+		authorCmd.Parse(os.Args[2:])
+
+		if *authorName == "" && *authorID == 0 {
+			log.Fatalln("expected author with -name or -id")
+			return
+		}
+
+		err := checkFormat(*authorFormat)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		types := splitList(*authorTypes)
+		if len(types) < 1 {
+			log.Fatalln("expected at least one publisher type with -publisher-type")
+			return
+		}
+
+		aliases, err := loadAliasTable(*authorAliases)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		_, w, err := createIO("", *authorOutput)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		lim := newLimiter(defaultMuRate)
+		defer lim.stop()
+
+		o := lookupOpts{
+			types:   types,
+			aliases: aliases,
+			limiter: lim,
+		}
+
+		err = listAuthor(ctx, *authorName, *authorID, w, *authorFormat, *authorTitles, o)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	case "publisher":
+		catalogCmd.Parse(os.Args[2:])
+
+		if *catalogName == "" && *catalogID == 0 {
+			log.Fatalln("expected publisher with -name or -id")
+			return
+		}
+
+		if *catalogPage < 1 || *catalogPerPage < 1 {
+			log.Fatalln("expected positive -page and -per-page")
+			return
+		}
+
+		err := checkFormat(*catalogFormat)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		types := splitList(*catalogTypes)
+		if len(types) < 1 {
+			log.Fatalln("expected at least one publisher type with -publisher-type")
+			return
+		}
+
+		aliases, err := loadAliasTable(*catalogAliases)
+		if err != nil {
+			log.Fatalln(err)
 			return
 		}
 
-		r, w, err := createIO(*coversFile, *coversOutput)
+		_, w, err := createIO("", *catalogOutput)
 		if err != nil {
-			log.Fatalln("error creating io:", err)
+			log.Fatalln(err)
+			return
+		}
+
+		lim := newLimiter(defaultMuRate)
+		defer lim.stop()
+
+		o := lookupOpts{
+			types:   types,
+			aliases: aliases,
+			limiter: lim,
+		}
+
+		err = listPublisher(ctx, *catalogName, *catalogID, *catalogPage, *catalogPerPage, w, *catalogFormat, *catalogTitles, o)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	case "diff":
+		diffCmd.Parse(os.Args[2:])
+
+		if *diffOld == "" || *diffNew == "" {
+			log.Fatalln("expected outputs to compare with -old and -new")
 			return
 		}
 
-		err = createCoverZips(ctx, r, w, *coversDir)
+		err := checkFormat(*diffFormat)
 		if err != nil {
-			log.Fatalln("error creating cover zips from csv:", err)
+			log.Fatalln(err)
+			return
+		}
+
+		_, w, err := createIO("", *diffOutput)
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+
+		err = diffFiles(*diffOld, *diffNew, w, *diffFormat)
+		if err != nil {
+			log.Fatalln(err)
 			return
 		}
 	default:
-		fmt.Println("expected publishers or covers command")
+		fmt.Println("expected publishers, covers, metadata, author, publisher or diff command")
 		return
 	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// manifestName is the name of the manifest written into each series
+// directory.
+const manifestName = "manifest.json"
+
+// manifest records where each cover file of a series directory came from.
+type manifest struct {
+	MangaID string          `json:"manga_id"`
+	Title   string          `json:"title"`
+	Covers  []manifestEntry `json:"covers"`
+}
+
+// manifestEntry is a single cover file of a manifest.
+type manifestEntry struct {
+	Volume      string    `json:"volume"`
+	CoverID     string    `json:"cover_id"`
+	FileName    string    `json:"file_name"`
+	Locale      string    `json:"locale"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Version     int       `json:"version"`
+	SHA256      string    `json:"sha256"`
+	// Path is the path of the cover file, relative to the manifest.
+	Path string `json:"path"`
+}
+
+// newManifestEntry returns the manifest entry of the cover c written to
+// the file at p.
+func newManifestEntry(c cover, p string) (manifestEntry, error) {
+	sum, err := hashFile(p)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	return manifestEntry{
+		Volume:      c.Volume,
+		CoverID:     c.ID,
+		FileName:    c.FileName,
+		Locale:      c.Locale,
+		Description: c.Description,
+		CreatedAt:   c.CreatedAt,
+		UpdatedAt:   c.UpdatedAt,
+		Version:     c.Version,
+		SHA256:      sum,
+		Path:        filepath.Base(p),
+	}, nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("error hashing %q: %w", p, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readManifest reads the manifest in dir, returning its entries by path.
+// A missing manifest has no entries.
+func readManifest(dir string) (map[string]manifestEntry, error) {
+	ret := make(map[string]manifestEntry)
+
+	bs, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	var m manifest
+	err = json.Unmarshal(bs, &m)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling manifest in %q: %w", dir, err)
+	}
+
+	for _, e := range m.Covers {
+		ret[e.Path] = e
+	}
+	return ret, nil
+}
+
+// changed reports whether c differs from the cover e was written from.
+func (e manifestEntry) changed(c cover) bool {
+	return e.CoverID != c.ID || e.Version != c.Version || !e.UpdatedAt.Equal(c.UpdatedAt)
+}
+
+// write writes m into dir, sorted by path.
+func (m *manifest) write(dir string) error {
+	sort.Slice(m.Covers, func(i, j int) bool {
+		return m.Covers[i].Path < m.Covers[j].Path
+	})
+
+	bs, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling manifest: %w", err)
+	}
+
+	return writeAtomic(filepath.Join(dir, manifestName), func(w io.Writer) error {
+		_, err := w.Write(append(bs, '\n'))
+		return err
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// metadataColumn is a field of a MangaUpdates series exported by the
+// metadata command.
+type metadataColumn struct {
+	name  string
+	value func(s *getSeriesResp) interface{}
+}
+
+var metadataColumns = []metadataColumn{
+	{"series_id", func(s *getSeriesResp) interface{} { return s.SeriesID }},
+	{"series_title", func(s *getSeriesResp) interface{} { return s.Title }},
+	{"url", func(s *getSeriesResp) interface{} { return s.URL }},
+	{"type", func(s *getSeriesResp) interface{} { return s.Type }},
+	{"year", func(s *getSeriesResp) interface{} { return s.Year }},
+	{"status", func(s *getSeriesResp) interface{} { return s.Status }},
+	{"licensed", func(s *getSeriesResp) interface{} { return s.Licensed }},
+	{"completed", func(s *getSeriesResp) interface{} { return s.Completed }},
+	{"latest_chapter", func(s *getSeriesResp) interface{} { return s.LatestChapter }},
+	{"bayesian_rating", func(s *getSeriesResp) interface{} { return s.BayesianRating }},
+	{"rating_votes", func(s *getSeriesResp) interface{} { return s.RatingVotes }},
+	{"associated", func(s *getSeriesResp) interface{} {
+		ret := []string{}
+		for _, a := range s.Associated {
+			ret = append(ret, a.Title)
+		}
+		return ret
+	}},
+	{"authors", func(s *getSeriesResp) interface{} {
+		ret := []string{}
+		for _, a := range s.Authors {
+			ret = append(ret, fmt.Sprintf("%s (%s)", a.Name, a.Type))
+		}
+		return ret
+	}},
+	{"genres", func(s *getSeriesResp) interface{} {
+		ret := []string{}
+		for _, g := range s.Genres {
+			ret = append(ret, g.Genre)
+		}
+		return ret
+	}},
+	{"categories", func(s *getSeriesResp) interface{} {
+		ret := []string{}
+		for _, c := range s.Categories {
+			ret = append(ret, c.Category)
+		}
+		return ret
+	}},
+	{"anime_start", func(s *getSeriesResp) interface{} { return s.Anime.Start }},
+	{"anime_end", func(s *getSeriesResp) interface{} { return s.Anime.End }},
+	{"rank_week", func(s *getSeriesResp) interface{} { return s.Rank.Position.Week }},
+	{"rank_month", func(s *getSeriesResp) interface{} { return s.Rank.Position.Month }},
+	{"rank_three_months", func(s *getSeriesResp) interface{} { return s.Rank.Position.ThreeMonths }},
+	{"rank_six_months", func(s *getSeriesResp) interface{} { return s.Rank.Position.SixMonths }},
+	{"rank_year", func(s *getSeriesResp) interface{} { return s.Rank.Position.Year }},
+	{"publishers", func(s *getSeriesResp) interface{} {
+		ret := []string{}
+		for _, p := range s.Publishers {
+			ret = append(ret, fmt.Sprintf("%s (%s)", p.PublisherName, p.Type))
+		}
+		return ret
+	}},
+	{"publications", func(s *getSeriesResp) interface{} {
+		ret := []string{}
+		for _, p := range s.Publications {
+			ret = append(ret, fmt.Sprintf("%s (%s)", p.PublicationName, p.PublisherName))
+		}
+		return ret
+	}},
+}
+
+// parseColumns returns the metadata columns named in the comma separated
+// list s, or every column if s is empty.
+func parseColumns(s string) ([]metadataColumn, error) {
+	if s == "" {
+		return metadataColumns, nil
+	}
+
+	var ret []metadataColumn
+outer:
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		for _, col := range metadataColumns {
+			if col.name == name {
+				ret = append(ret, col)
+				continue outer
+			}
+		}
+		return nil, fmt.Errorf("unknown column %q", name)
+	}
+
+	return ret, nil
+}
+
+// metadataRecord is a row of the metadata export. series is nil if the
+// title wasn't found.
+type metadataRecord struct {
+	cols   []metadataColumn
+	title  string
+	match  string
+	series *getSeriesResp
+}
+
+func metadataHeader(cols []metadataColumn) []string {
+	ret := []string{"title", "match"}
+	for _, col := range cols {
+		ret = append(ret, col.name)
+	}
+	return ret
+}
+
+func (m metadataRecord) row() []string {
+	ret := []string{m.title, m.match}
+	for _, col := range m.cols {
+		if m.series == nil {
+			ret = append(ret, "")
+			continue
+		}
+		ret = append(ret, formatValue(col.value(m.series)))
+	}
+	return ret
+}
+
+// MarshalJSON writes m as an object with its keys in column order.
+func (m metadataRecord) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("{")
+
+	write := func(k string, v interface{}) error {
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return err
+		}
+		vb, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if b.Len() > 1 {
+			b.WriteString(",")
+		}
+		b.Write(kb)
+		b.WriteString(":")
+		b.Write(vb)
+		return nil
+	}
+
+	err := write("title", m.title)
+	if err != nil {
+		return nil, err
+	}
+	err = write("match", m.match)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.series != nil {
+		for _, col := range m.cols {
+			err = write(col.name, col.value(m.series))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	b.WriteString("}")
+	return b.Bytes(), nil
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, listSep)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(v)
+}
+
+func exportMetadata(ctx context.Context, r io.Reader, w io.WriteCloser, format string, cols []metadataColumn, o lookupOpts) (err error) {
+	mw, err := newRecordWriter[metadataRecord](w, format, metadataHeader(cols))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := mw.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	csvr := csv.NewReader(r)
+	records, err := csvr.ReadAll()
+	if err != nil {
+		return fmt.Errorf("error reading records from CSV: %w", err)
+	}
+
+	for _, record := range records {
+		if len(record) != 1 {
+			return fmt.Errorf("wanted one column, got %d", len(record))
+		}
+	}
+
+	processed := 0
+	defer func() {
+		var skipped []string
+		for _, record := range records[processed:] {
+			skipped = append(skipped, record[0])
+		}
+		logSummary(len(records), skipped)
+	}()
+
+	for _, record := range records {
+		err = o.limiter.wait(ctx)
+		if err != nil {
+			return fmt.Errorf("stopped before %q: %w", record[0], err)
+		}
+
+		rec := metadataRecord{cols: cols, title: record[0], match: matchNone}
+
+		log.Printf("searching for %q... ", record[0])
+		title, id, err := postMuSearch(record[0])
+		if err != nil && !errors.Is(err, errNotEnoughResults) {
+			return fmt.Errorf("error searching manga %q: %w", record[0], err)
+		}
+
+		if err == nil {
+			rec.match = matchExact
+			if title != record[0] {
+				rec.match = matchInexact
+			}
+
+			err = o.limiter.wait(ctx)
+			if err != nil {
+				return fmt.Errorf("stopped before %q: %w", record[0], err)
+			}
+
+			rec.series, err = getmuSeries(id)
+			if err != nil {
+				return fmt.Errorf("error getting manga %q with id %d: %w", record[0], id, err)
+			}
+		}
+
+		err = mw.Write(rec)
+		if err != nil {
+			return err
+		}
+		processed++
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultNameTemplate = `{{.Title}} - {{if .Volume}}Volume {{.Volume}}{{else}}No Volume{{end}}`
+	defaultDirTemplate  = `{{.Title}}`
+	// localeSuffix is appended to a name template that doesn't use the
+	// locale when every locale's cover is kept, so the names stay unique.
+	localeSuffix = ` ({{.Locale}})`
+)
+
+// reservedChars are the characters that can't appear in file names on
+// at least one common file system.
+var reservedChars = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]`)
+
+// nameFields are the fields the -name-template and -dir-template are
+// executed with. The directory template only gets the series fields.
+type nameFields struct {
+	Title   string
+	MangaID string
+	Year    int
+	Volume  string
+	Locale  string
+	CoverID string
+}
+
+// naming names the series directories and cover files of a covers run.
+type naming struct {
+	name, dir *template.Template
+	// year reports whether either template uses the year, which needs the
+	// manga to be fetched.
+	year bool
+}
+
+// padVolume zero-pads the integer part of the volume v to width digits,
+// keeping any decimal part, so 1 becomes 01 and 1.5 becomes 01.5 for a
+// width of 2. Volumes that aren't numbers are returned as they are.
+func padVolume(width int, v string) string {
+	n, dec := v, ""
+	if i := strings.IndexByte(v, '.'); i >= 0 {
+		n, dec = v[:i], v[i:]
+	}
+	if _, err := strconv.ParseUint(n, 10, 64); err != nil {
+		return v
+	}
+	if len(n) < width {
+		n = strings.Repeat("0", width-len(n)) + n
+	}
+	return n + dec
+}
+
+var nameFuncs = template.FuncMap{
+	"pad": padVolume,
+}
+
+// sampleFields are the fields templates are checked against.
+var sampleFields = nameFields{
+	Title:   "Title",
+	MangaID: "a1c7c817-4e59-43b7-9365-09675a149a6f",
+	Year:    2000,
+	Volume:  "1",
+	Locale:  "ja",
+	CoverID: "b1e1a2b4-9a2c-4c9e-8f43-2d5b3c8f1a10",
+}
+
+// newNaming parses and checks the name and dir templates. Unless the name
+// template uses the locale, allLocales appends it to each name.
+func newNaming(name, dir string, allLocales bool) (*naming, error) {
+	n := &naming{}
+
+	var err error
+	n.name, err = parseName("name", name)
+	if err != nil {
+		return nil, err
+	}
+	n.dir, err = parseName("dir", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	uses := func(t *template.Template, change func(*nameFields)) (bool, error) {
+		f := sampleFields
+		change(&f)
+		a, err := execName(t, sampleFields)
+		if err != nil {
+			return false, err
+		}
+		b, err := execName(t, f)
+		if err != nil {
+			return false, err
+		}
+		return a != b, nil
+	}
+	var (
+		volume  = func(f *nameFields) { f.Volume = "2" }
+		locale  = func(f *nameFields) { f.Locale = "en" }
+		coverID = func(f *nameFields) { f.CoverID = "c" }
+		year    = func(f *nameFields) { f.Year = 2001 }
+	)
+
+	if allLocales {
+		ok, err := uses(n.name, locale)
+		if err != nil {
+			return nil, fmt.Errorf("error in name template: %w", err)
+		}
+		if !ok {
+			n.name, err = parseName("name", name+localeSuffix)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	byVolume, err := uses(n.name, volume)
+	if err != nil {
+		return nil, fmt.Errorf("error in name template: %w", err)
+	}
+	byCover, err := uses(n.name, coverID)
+	if err != nil {
+		return nil, fmt.Errorf("error in name template: %w", err)
+	}
+	if !byVolume && !byCover {
+		return nil, errors.New("name template must use .Volume or .CoverID, or every cover gets the same name")
+	}
+
+	for _, change := range []func(*nameFields){volume, locale, coverID} {
+		ok, err := uses(n.dir, change)
+		if err != nil {
+			return nil, fmt.Errorf("error in dir template: %w", err)
+		}
+		if ok {
+			return nil, errors.New("dir template can only use .Title, .MangaID and .Year")
+		}
+	}
+
+	for _, t := range []*template.Template{n.name, n.dir} {
+		ok, err := uses(t, year)
+		if err != nil {
+			return nil, err
+		}
+		n.year = n.year || ok
+	}
+
+	return n, nil
+}
+
+func parseName(kind, text string) (*template.Template, error) {
+	t, err := template.New(kind).Funcs(nameFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s template: %w", kind, err)
+	}
+	_, err = execName(t, sampleFields)
+	if err != nil {
+		return nil, fmt.Errorf("error in %s template: %w", kind, err)
+	}
+	return t, nil
+}
+
+// execName executes t with f and cleans the result into a file name.
+func execName(t *template.Template, f nameFields) (string, error) {
+	var sb strings.Builder
+	err := t.Execute(&sb, f)
+	if err != nil {
+		return "", err
+	}
+
+	s := strings.TrimSpace(reservedChars.ReplaceAllString(sb.String(), "_"))
+	if s == "" || s == "." || s == ".." {
+		return "", fmt.Errorf("template gives the invalid name %q", s)
+	}
+	return s, nil
+}
+
+// dirName returns the name of the directory of the series of f.
+func (n *naming) dirName(f nameFields) (string, error) {
+	s, err := execName(n.dir, f)
+	if err != nil {
+		return "", fmt.Errorf("error naming directory of %q: %w", f.Title, err)
+	}
+	return s, nil
+}
+
+// fileName returns the name of the cover file of f, without extension.
+func (n *naming) fileName(f nameFields) (string, error) {
+	s, err := execName(n.name, f)
+	if err != nil {
+		return "", fmt.Errorf("error naming cover %s of %q: %w", f.CoverID, f.Title, err)
+	}
+	return s, nil
+}
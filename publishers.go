@@ -8,7 +8,11 @@ import (
 	"io"
 	"log"
 	"net/url"
-	"time"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kipukun/shmanga/group"
 )
 
 const (
@@ -185,86 +189,325 @@ func postMuSearch(name string) (string, int64, error) {
 	return mus.Results[0].Record.Title, mus.Results[0].Record.SeriesID, nil
 }
 
-func getmuSeries(id int64) ([]string, error) {
+func getmuSeries(id int64) (*getSeriesResp, error) {
 	resp, err := get[getSeriesResp](fmt.Sprintf(muSeriesEndpoint, id))
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving series: %w", err)
 	}
 
-	var ret []string
-	for _, publisher := range resp.Publishers {
-		if publisher.Type == "English" {
-			ret = append(ret, publisher.PublisherName)
+	return &resp, nil
+}
+
+// publisher is a publisher of a series as listed on MangaUpdates.
+type publisher struct {
+	Name string `json:"name"`
+	// Canonical is Name with imprints and variant spellings resolved.
+	Canonical string `json:"canonical"`
+	// Type is the language of the publisher, or Original for the
+	// publisher of the original work.
+	Type  string `json:"type"`
+	Notes string `json:"notes,omitempty"`
+	releaseInfo
+}
+
+const (
+	releaseOngoing   = "ongoing"
+	releaseComplete  = "complete"
+	releaseCancelled = "cancelled"
+	releaseHiatus    = "hiatus"
+)
+
+// releaseInfo is what a publisher's notes say about its release of a series.
+type releaseInfo struct {
+	// Volumes is the number of volumes released, or 0 if unknown.
+	Volumes int `json:"volumes,omitempty"`
+	// Status is one of ongoing, complete, cancelled or hiatus, or empty if
+	// unknown.
+	Status string `json:"release_status,omitempty"`
+	// Format is some of print, digital and omnibus joined by "+", or empty if
+	// unknown.
+	Format string `json:"format,omitempty"`
+}
+
+var (
+	notesVolumes     = regexp.MustCompile(`(?i)(\d+)\s+(?:[a-z0-9-]+\s+)?vol`)
+	notesVolumeRange = regexp.MustCompile(`(?i)vol(?:ume)?s?\.?\s*\d+\s*[-~]\s*(\d+)`)
+
+	notesStatuses = []struct {
+		re     *regexp.Regexp
+		status string
+	}{
+		{regexp.MustCompile(`(?i)cancel|discontinued|dropped`), releaseCancelled},
+		{regexp.MustCompile(`(?i)hiatus`), releaseHiatus},
+		{regexp.MustCompile(`(?i)complete|finished`), releaseComplete},
+		{regexp.MustCompile(`(?i)ongoing|on-going`), releaseOngoing},
+	}
+
+	notesFormats = []struct {
+		re     *regexp.Regexp
+		format string
+	}{
+		{regexp.MustCompile(`(?i)print|physical|paperback`), "print"},
+		{regexp.MustCompile(`(?i)digital|e-?book`), "digital"},
+		{regexp.MustCompile(`(?i)omnibus|\d-in-\d`), "omnibus"},
+	}
+)
+
+// parseNotes extracts the release info from the free form notes of a
+// MangaUpdates publisher, such as "7 Volumes (Complete)".
+func parseNotes(notes string) releaseInfo {
+	var ri releaseInfo
+
+	if m := notesVolumes.FindStringSubmatch(notes); m != nil {
+		ri.Volumes, _ = strconv.Atoi(m[1])
+	} else if m := notesVolumeRange.FindStringSubmatch(notes); m != nil {
+		ri.Volumes, _ = strconv.Atoi(m[1])
+	}
+
+	for _, s := range notesStatuses {
+		if s.re.MatchString(notes) {
+			ri.Status = s.status
+			break
+		}
+	}
+
+	var formats []string
+	for _, f := range notesFormats {
+		if f.re.MatchString(notes) {
+			formats = append(formats, f.format)
 		}
 	}
+	ri.Format = strings.Join(formats, "+")
 
-	return ret, nil
+	return ri
 }
 
-func searchList(ctx context.Context, r io.Reader, w io.WriteCloser) error {
-	defer w.Close()
+// lookupOpts configures how titles are looked up on MangaUpdates.
+type lookupOpts struct {
+	// types are the publisher types to include.
+	types []string
+	// aliases resolves the canonical publisher names.
+	aliases aliasTable
+	// limiter spaces out the requests to MangaUpdates.
+	limiter *limiter
+	// related configures the expansion to related series.
+	related relatedOpts
+}
 
-	csvr := csv.NewReader(r)
-	csvw := csv.NewWriter(w)
-	records, err := csvr.ReadAll()
+// filterPublishers returns the publishers of s whose type is one of
+// o.types, ignoring case.
+func filterPublishers(s *getSeriesResp, o lookupOpts) []publisher {
+	var ret []publisher
+	for _, p := range s.Publishers {
+		for _, t := range o.types {
+			if strings.EqualFold(p.Type, t) {
+				ret = append(ret, publisher{
+					Name:        p.PublisherName,
+					Canonical:   o.aliases.canonical(p.PublisherName),
+					Type:        p.Type,
+					Notes:       p.Notes,
+					releaseInfo: parseNotes(p.Notes),
+				})
+				break
+			}
+		}
+	}
+
+	return ret
+}
+
+// lookupTitle searches MangaUpdates for name and resolves its publishers
+// according to o. The first result is that of name itself, followed by
+// any of its related series if o expands them.
+func lookupTitle(ctx context.Context, name string, o lookupOpts) ([]result, error) {
+	res := result{Title: name, Match: matchNone}
+
+	err := o.limiter.wait(ctx)
 	if err != nil {
-		return fmt.Errorf("error reading records from CSV: %w", err)
+		return nil, err
 	}
 
-	err = csvw.Write([]string{"title", "publishers"})
+	log.Printf("searching for %q...", name)
+	title, id, err := postMuSearch(name)
 	if err != nil {
-		return fmt.Errorf("error writing header: %w", err)
+		if errors.Is(err, errNotEnoughResults) {
+			res.Reason = "no search results"
+			return []result{res}, nil
+		}
+		return nil, fmt.Errorf("error searching manga %q: %w", name, err)
 	}
+	log.Printf("found %q! id: %d", name, id)
 
-	ticker := time.NewTicker(5 * time.Second)
+	res.SeriesID = id
+	res.matchResult(title)
 
-	for _, record := range records {
-		select {
-		case <-ctx.Done():
-			return errors.New("context cancelled")
-		case <-ticker.C:
+	err = o.limiter.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	series, err := getmuSeries(id)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manga %q with id %d: %w", name, id, err)
+	}
+	res.seriesResult(series, o)
+
+	results := []result{res}
+
+	rels, err := expandRelated(ctx, series, o)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range rels {
+		rr := result{
+			Title:       rel.name,
+			SeriesID:    rel.series.SeriesID,
+			DerivedFrom: name,
+			Relation:    rel.relation,
+		}
+		rr.matchResult(rel.series.Title)
+		rr.seriesResult(rel.series, o)
+		results = append(results, rr)
+	}
+
+	return results, nil
+}
+
+// seriesResult fills in r from the MangaUpdates series s.
+func (r *result) seriesResult(s *getSeriesResp, o lookupOpts) {
+	r.URL = s.URL
+	r.Licensed = &s.Licensed
+	r.Completed = &s.Completed
+	r.Status = s.Status
+	r.Publishers = filterPublishers(s, o)
+
+	if len(r.Publishers) < 1 {
+		log.Printf("\t%q publishers: none", r.Title)
+		if r.Reason == "" {
+			r.Reason = fmt.Sprintf("no %s publishers", strings.Join(o.types, " or "))
 		}
+		return
+	}
+	log.Printf("\t%q publishers: %v", r.Title, r.Publishers)
+}
 
+type lookup struct {
+	results []result
+	err     error
+}
+
+// searchList looks up the titles read from r and writes the results to w
+// in input order. Up to concurrency titles are looked up at once, with
+// requests spaced out by o.limiter.
+func searchList(ctx context.Context, r io.Reader, w io.WriteCloser, format, groupBy string, concurrency int, o lookupOpts, cp *checkpoint) (err error) {
+	rw, err := newResultWriter(w, format, groupBy)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := rw.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	csvr := csv.NewReader(r)
+	records, err := csvr.ReadAll()
+	if err != nil {
+		return fmt.Errorf("error reading records from CSV: %w", err)
+	}
+
+	o.related.inputs = make(map[string]bool, len(records))
+	for _, record := range records {
 		if len(record) != 1 {
 			return fmt.Errorf("wanted one column, got %d", len(record))
 		}
-		log.Printf("searching for %q... ", record[0])
-		name, id, err := postMuSearch(record[0])
-		if err != nil {
-			if errors.Is(err, errNotEnoughResults) || name != record[0] {
-				csvw.Write([]string{record[0], "exact match not found"})
+		o.related.inputs[strings.ToLower(record[0])] = true
+	}
+
+	processed := 0
+	defer func() {
+		var skipped []string
+		for _, record := range records[processed:] {
+			skipped = append(skipped, record[0])
+		}
+		logSummary(len(records), skipped)
+	}()
+
+	// the series already written, as a series can be related to several
+	// input titles but must only be written, and counted, once
+	written := make(map[int64]bool)
+	write := func(results []result) error {
+		for _, res := range results {
+			if res.DerivedFrom != "" && written[res.SeriesID] {
 				continue
 			}
-			return fmt.Errorf("error searching manga %q: %w", record[0], err)
+			if res.SeriesID != 0 {
+				written[res.SeriesID] = true
+			}
+			err := rw.Write(res)
+			if err != nil {
+				return err
+			}
 		}
-		log.Printf("found! id: %d\n", id)
-		pubs, err := getmuSeries(id)
-		if err != nil {
-			return fmt.Errorf("error getting manga %q with id %d: %w", record[0], id, err)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	g, ctx := group.WithContext(ctx)
+	g.Limit(concurrency)
+	defer func() {
+		cancel()
+		g.Drain()
+	}()
+
+	pending := make([]chan lookup, len(records))
+	for i, record := range records {
+		if _, ok := cp.lookup(record[0]); ok {
+			continue
 		}
-		log.Print("\tpublishers: ")
 
-		if len(pubs) < 1 {
-			log.Print("none")
-			err = csvw.Write([]string{record[0], ""})
+		ch := make(chan lookup, 1)
+		pending[i] = ch
+		title := record[0]
+
+		g.Do(ctx, func() error {
+			results, err := lookupTitle(ctx, title, o)
+			ch <- lookup{results: results, err: err}
+			return nil
+		})
+	}
+
+	for i, record := range records {
+		if results, ok := cp.lookup(record[0]); ok {
+			err = write(results)
 			if err != nil {
-				return fmt.Errorf("error writing CSV row: %w", err)
+				return err
 			}
+			processed++
 			continue
 		}
 
-		log.Printf("%v", pubs)
+		var l lookup
+		select {
+		case l = <-pending[i]:
+		case <-ctx.Done():
+			return fmt.Errorf("stopped before %q: %w", record[0], ctx.Err())
+		}
+		if l.err != nil {
+			return l.err
+		}
 
-		err = csvw.Write([]string{record[0], fmt.Sprintf("%v", pubs)})
+		err = cp.record(l.results)
 		if err != nil {
-			return fmt.Errorf("error writing CSV row: %w", err)
+			return err
 		}
-	}
 
-	csvw.Flush()
-	err = csvw.Error()
-	if err != nil {
-		return fmt.Errorf("error flushing csv writer: %w", err)
+		err = write(l.results)
+		if err != nil {
+			return err
+		}
+		processed++
 	}
 
 	return nil
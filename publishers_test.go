@@ -1,7 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -13,3 +25,367 @@ func TestPostSearch(t *testing.T) {
 	}
 	fmt.Println(id)
 }
+
+func TestParseNotes(t *testing.T) {
+	tests := []struct {
+		notes string
+		want  releaseInfo
+	}{
+		{"", releaseInfo{}},
+		{"7 Volumes (Complete)", releaseInfo{Volumes: 7, Status: releaseComplete}},
+		{"14 Volumes (Ongoing)", releaseInfo{Volumes: 14, Status: releaseOngoing}},
+		{"Digital: 3 Volumes (Ongoing)", releaseInfo{Volumes: 3, Status: releaseOngoing, Format: "digital"}},
+		{"5 Omnibus Volumes (Complete)", releaseInfo{Volumes: 5, Status: releaseComplete, Format: "omnibus"}},
+		{"2-in-1 edition, Vol. 1-4, cancelled", releaseInfo{Volumes: 4, Status: releaseCancelled, Format: "omnibus"}},
+		{"Print and digital, 1 volume (Complete)", releaseInfo{Volumes: 1, Status: releaseComplete, Format: "print+digital"}},
+	}
+
+	for _, tt := range tests {
+		got := parseNotes(tt.notes)
+		if got != tt.want {
+			t.Errorf("parseNotes(%q) = %+v, want %+v", tt.notes, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalPublisher(t *testing.T) {
+	at := newAliasTable()
+	err := at.load(strings.NewReader("Yen Audio,Yen Press\nSeven Seas,Seven Seas Entertainment\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"Yen Press":           "Yen Press",
+		"Yen Press (Digital)": "Yen Press",
+		"Yen On":              "Yen Press",
+		"yen  audio":          "Yen Press",
+		"Seven Seas":          "Seven Seas Entertainment",
+		"Ghost Ship":          "Seven Seas",
+		"Unknown (Digital)":   "Unknown",
+		"Unknown":             "Unknown",
+	}
+
+	for name, want := range tests {
+		got := at.canonical(name)
+		if got != want {
+			t.Errorf("canonical(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestDiffResults(t *testing.T) {
+	yes, no := true, false
+	old := []result{
+		{Title: "A", Match: matchExact, Licensed: &no, Completed: &no, Status: "3 Volumes (Ongoing)"},
+		{Title: "B", Match: matchExact, Licensed: &yes, Completed: &no, Publishers: []publisher{
+			{Name: "Yen On", Canonical: "Yen Press", Type: "English"},
+			{Name: "Tokyopop", Canonical: "TOKYOPOP", Type: "English"},
+		}},
+		{Title: "C", Match: matchNone},
+	}
+	cur := []result{
+		{Title: "A", Match: matchExact, Licensed: &yes, Completed: &yes, Status: "4 Volumes (Complete)", Publishers: []publisher{
+			{Name: "Seven Seas Entertainment", Canonical: "Seven Seas", Type: "English", Notes: "1 Volume (Ongoing)"},
+		}},
+		{Title: "B", Match: matchExact, Licensed: &yes, Completed: &no, Publishers: []publisher{
+			{Name: "Yen Press (Digital)", Canonical: "Yen Press", Type: "English"},
+		}},
+		{Title: "C", Match: matchExact, Licensed: &yes},
+	}
+
+	// round trip the previous run through CSV, as diff reads it back
+	buf := nopCloser{new(bytes.Buffer)}
+	rw, err := newResultWriter(buf, formatCSV, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeResults(rw, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err = readResults(buf, formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []change{
+		{Title: "A", Change: changeNewlyLicensed, Old: "false", New: "true"},
+		{Title: "A", Change: changePublisherAdded, New: "Seven Seas"},
+		{Title: "A", Change: changeCompleted, Old: "false", New: "true"},
+		{Title: "A", Change: changeStatus, Old: "3 Volumes (Ongoing)", New: "4 Volumes (Complete)"},
+		{Title: "B", Change: changePublisherRemoved, Old: "TOKYOPOP"},
+	}
+
+	got := diffResults(old, cur)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("diffResults() = %+v, want %+v", got, want)
+	}
+
+	// outputs from before the licensed, completed and status columns
+	// only show the publisher changes
+	older := "title,resolved_title,series_id,manga_id,url,match,confidence,publishers,covers,reason\n" +
+		"A,A,1,,,exact,1,,,\n" +
+		"B,B,2,,,exact,1,Yen On; Tokyopop,,\n"
+	old, err = readResults(strings.NewReader(older), formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = []change{
+		{Title: "A", Change: changePublisherAdded, New: "Seven Seas"},
+		{Title: "B", Change: changePublisherAdded, New: "Yen Press"},
+		{Title: "B", Change: changePublisherRemoved, Old: "Tokyopop"},
+		{Title: "B", Change: changePublisherRemoved, Old: "Yen On"},
+	}
+
+	got = diffResults(old, cur)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("diffResults() of older output = %+v, want %+v", got, want)
+	}
+}
+
+func TestGroupByPublishers(t *testing.T) {
+	yes, no := true, false
+	yen := []publisher{{Name: "Yen On", Canonical: "Yen Press", Type: "English"}}
+	kodansha := []publisher{{Name: "Kodansha", Canonical: "Kodansha", Type: "Original"}}
+	results := []result{
+		{Title: "A", Match: matchExact, Licensed: &yes, Publishers: yen},
+		{Title: "B", Match: matchInexact, Licensed: &yes, Publishers: yen},
+		{Title: "C", Match: matchExact, Licensed: &no},
+		{Title: "D", Match: matchInexact, Licensed: &no},
+		{Title: "E", Match: matchNone},
+		{Title: "F", Match: matchExact, Licensed: &no, Publishers: kodansha},
+		{Title: "G", Match: matchExact, Licensed: &yes},
+		{Title: "H", Match: matchExact, Publishers: kodansha},
+	}
+
+	want := []publisherGroup{
+		{Kind: groupPublisher, Publisher: "Kodansha", Count: 2, Titles: []string{"F", "H"}},
+		{Kind: groupPublisher, Publisher: "Yen Press", Count: 1, Titles: []string{"A"}},
+		{Kind: groupUnlicensed, Count: 3, Titles: []string{"C", "F", "H"}},
+		{Kind: groupNoPublisher, Count: 1, Titles: []string{"G"}},
+		{Kind: groupInexact, Count: 2, Titles: []string{"B", "D"}},
+	}
+
+	got := groupByPublishers(results)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("groupByPublishers() = %+v, want %+v", got, want)
+	}
+}
+
+// fakeSeries is a series served by fakeMu.
+type fakeSeries struct {
+	id         int64
+	title      string
+	publishers []string
+	// related are the relation types of the related series, by id.
+	related map[int64]string
+}
+
+// fakeMu serves series from a fake MangaUpdates API until the test ends,
+// returning the number of times each series was fetched.
+func fakeMu(t *testing.T, series []fakeSeries) func(id int64) int {
+	var (
+		mu      sync.Mutex
+		fetched = make(map[int64]int)
+	)
+	byID := make(map[int64]fakeSeries)
+	for _, s := range series {
+		byID[s.id] = s
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/series/search" {
+			var results []map[string]interface{}
+			for _, s := range series {
+				if strings.EqualFold(s.title, r.PostFormValue("search")) {
+					results = append(results, map[string]interface{}{
+						"record": map[string]interface{}{"series_id": s.id, "title": s.title},
+					})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+			return
+		}
+
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/v1/series/"), 10, 64)
+		s, ok := byID[id]
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		fetched[id]++
+		mu.Unlock()
+
+		resp := map[string]interface{}{"series_id": s.id, "title": s.title, "licensed": len(s.publishers) > 0}
+		var pubs, rels []map[string]interface{}
+		for _, p := range s.publishers {
+			pubs = append(pubs, map[string]interface{}{"publisher_name": p, "type": "English"})
+		}
+		for rid, relation := range s.related {
+			rels = append(rels, map[string]interface{}{
+				"relation_type": relation, "related_series_id": rid, "related_series_name": byID[rid].title,
+			})
+		}
+		sort.Slice(rels, func(i, j int) bool {
+			return rels[i]["related_series_id"].(int64) < rels[j]["related_series_id"].(int64)
+		})
+		resp["publishers"], resp["related_series"] = pubs, rels
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	routeTo(t, srv)
+
+	return func(id int64) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetched[id]
+	}
+}
+
+func TestExpandRelated(t *testing.T) {
+	fetched := fakeMu(t, []fakeSeries{
+		{id: 1, title: "Root", related: map[int64]string{2: "Sequel", 3: "Spin-Off", 5: "Sequel"}},
+		{id: 2, title: "Root 2", related: map[int64]string{1: "Prequel", 4: "Sequel"}},
+		{id: 3, title: "Root Side Story"},
+		{id: 4, title: "Root 3", related: map[int64]string{6: "Sequel"}},
+		{id: 5, title: "Input"},
+		{id: 6, title: "Root 4"},
+	})
+
+	root, err := getmuSeries(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := lookupOpts{related: relatedOpts{
+		depth:  2,
+		types:  []string{"sequel"},
+		inputs: map[string]bool{"input": true},
+	}}
+	rels, err := expandRelated(context.Background(), root, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, rel := range rels {
+		got = append(got, fmt.Sprintf("%s %s", rel.relation, rel.name))
+	}
+	want := []string{"Sequel Root 2", "Sequel Root 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandRelated() = %v, want %v", got, want)
+	}
+
+	for id, n := range map[int64]int{1: 1, 2: 1, 3: 0, 4: 1, 5: 0, 6: 0} {
+		if fetched(id) != n {
+			t.Errorf("series %d fetched %d times, want %d", id, fetched(id), n)
+		}
+	}
+}
+
+func TestSearchListRelated(t *testing.T) {
+	fakeMu(t, []fakeSeries{
+		{id: 1, title: "A", publishers: []string{"Yen Press"}, related: map[int64]string{3: "Sequel", 2: "Sequel"}},
+		{id: 2, title: "B", publishers: []string{"Yen Press"}, related: map[int64]string{3: "Sequel"}},
+		{id: 3, title: "C", publishers: []string{"Yen Press"}},
+	})
+
+	o := lookupOpts{types: []string{"English"}, aliases: newAliasTable(), related: relatedOpts{depth: 1}}
+	buf := nopCloser{new(bytes.Buffer)}
+	err := searchList(context.Background(), strings.NewReader("A\nB\n"), buf, formatNDJSON, "", 2, o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := readResults(buf, formatNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// B is an input title and C is related to both
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Title+"<"+r.DerivedFrom)
+	}
+	want := []string{"A<", "C<A", "B<"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("searchList() wrote %v, want %v", got, want)
+	}
+}
+
+func TestSearchListResume(t *testing.T) {
+	fetched := fakeMu(t, []fakeSeries{
+		{id: 1, title: "A", publishers: []string{"Yen Press"}},
+		{id: 2, title: "B", publishers: []string{"Seven Seas"}},
+		{id: 3, title: "C"},
+	})
+
+	// A was finished, and B cut short when the last run was killed
+	path := filepath.Join(t.TempDir(), "out.csv.checkpoint")
+	done := `[{"title":"A","series_id":1,"match":"exact","reason":"from checkpoint"}]` + "\n"
+	cut := `[{"title":"B","series_id":2,"ma`
+	err := os.WriteFile(path, []byte(done+cut), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := openCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := lookupOpts{types: []string{"English"}, aliases: newAliasTable()}
+	buf := nopCloser{new(bytes.Buffer)}
+	err = searchList(context.Background(), strings.NewReader("A\nB\nC\n"), buf, formatNDJSON, "", 2, o, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := readResults(buf, formatNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Title+":"+r.Reason)
+	}
+	want := []string{"A:from checkpoint", "B:", "C:no English publishers"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed run wrote %v, want %v", got, want)
+	}
+	if n := fetched(1); n != 0 {
+		t.Errorf("checkpointed title looked up %d times, want 0", n)
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n")
+	if len(lines) != 4 || lines[0]+"\n" != done || lines[1] != cut {
+		t.Fatalf("checkpoint is %q, want the old lines followed by B and C", bs)
+	}
+	for i, title := range []string{"B", "C"} {
+		var rs []result
+		err = json.Unmarshal([]byte(lines[i+2]), &rs)
+		if err != nil || len(rs) != 1 || rs[0].Title != title {
+			t.Errorf("checkpoint line %d is %q, want the results of %s", i+3, lines[i+2], title)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// relatedOpts configures the expansion of series to their related series,
+// such as sequels and spin-offs.
+type relatedOpts struct {
+	// depth is how many relations deep to follow, 0 disables expansion.
+	depth int
+	// types are the relation types to follow, ignoring case, or all if
+	// empty.
+	types []string
+	// inputs are the input titles, lower cased, which are looked up in
+	// their own right and so never followed as related series.
+	inputs map[string]bool
+}
+
+// parseRelatedOpts returns the relatedOpts for the -expand-related,
+// -relation-types and -depth flags.
+func parseRelatedOpts(expand bool, types string, depth int) relatedOpts {
+	if !expand {
+		return relatedOpts{}
+	}
+	return relatedOpts{depth: depth, types: splitList(types)}
+}
+
+func (ro relatedOpts) follows(relation string) bool {
+	if len(ro.types) == 0 {
+		return true
+	}
+	for _, t := range ro.types {
+		if strings.EqualFold(t, relation) {
+			return true
+		}
+	}
+	return false
+}
+
+// related is a series reached from another through its related series.
+type related struct {
+	series *getSeriesResp
+	// name is the name of the series as given in the relation.
+	name string
+	// relation is the type of the last relation followed to reach series,
+	// such as Sequel or Spin-Off.
+	relation string
+}
+
+// expandRelated walks the related series of root breadth first, up to
+// o.related.depth relations deep, following only the relation types in
+// o.related. Each series is returned once, and neither root nor any of
+// the input titles ever.
+func expandRelated(ctx context.Context, root *getSeriesResp, o lookupOpts) ([]related, error) {
+	var ret []related
+
+	seen := map[int64]bool{root.SeriesID: true}
+	level := []*getSeriesResp{root}
+
+	for depth := 0; depth < o.related.depth && len(level) > 0; depth++ {
+		var next []*getSeriesResp
+		for _, s := range level {
+			for _, rs := range s.RelatedSeries {
+				if seen[rs.RelatedSeriesID] || !o.related.follows(rs.RelationType) || o.related.inputs[strings.ToLower(rs.RelatedSeriesName)] {
+					continue
+				}
+				seen[rs.RelatedSeriesID] = true
+
+				err := o.limiter.wait(ctx)
+				if err != nil {
+					return ret, err
+				}
+
+				log.Printf("\t%s of %q: %q", rs.RelationType, s.Title, rs.RelatedSeriesName)
+				series, err := getmuSeries(rs.RelatedSeriesID)
+				if err != nil {
+					return ret, fmt.Errorf("error getting related series %q with id %d: %w", rs.RelatedSeriesName, rs.RelatedSeriesID, err)
+				}
+
+				ret = append(ret, related{series: series, name: rs.RelatedSeriesName, relation: rs.RelationType})
+				next = append(next, series)
+			}
+		}
+		level = next
+	}
+
+	return ret, nil
+}
+
+// relatedTitles searches MangaUpdates for name and returns its related
+// series according to o, or none if name isn't found.
+func relatedTitles(ctx context.Context, name string, o lookupOpts) ([]related, error) {
+	err := o.limiter.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, id, err := postMuSearch(name)
+	if err != nil {
+		if errors.Is(err, errNotEnoughResults) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error searching manga %q: %w", name, err)
+	}
+
+	err = o.limiter.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	series, err := getmuSeries(id)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manga %q with id %d: %w", name, id, err)
+	}
+
+	return expandRelated(ctx, series, o)
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	matchExact   = "exact"
+	matchInexact = "inexact"
+	matchNone    = "none"
+)
+
+const (
+	formatCSV    = "csv"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+// listSep separates the elements of list valued columns in CSV output.
+const listSep = "; "
+
+// result is the outcome of looking up a single input title. It is the
+// record schema shared by the publishers and covers commands, whichever
+// the output format; fields a command doesn't fill are left empty.
+type result struct {
+	// Title is the title as given in the input.
+	Title string `json:"title"`
+	// ResolvedTitle is the title of the series Title was matched to.
+	ResolvedTitle string `json:"resolved_title,omitempty"`
+	// SeriesID is the MangaUpdates series ID.
+	SeriesID int64 `json:"series_id,omitempty"`
+	// MangaID is the MangaDex manga UUID.
+	MangaID string `json:"manga_id,omitempty"`
+	// URL is the web page of the matched series.
+	URL string `json:"url,omitempty"`
+	// Match is one of exact, inexact or none.
+	Match string `json:"match"`
+	// Confidence is the similarity of Title and ResolvedTitle, from 0 to 1.
+	Confidence float64 `json:"confidence"`
+	// Licensed is whether the series is licensed in English, or nil if
+	// unknown.
+	Licensed *bool `json:"licensed,omitempty"`
+	// Completed is whether the series is complete in its original
+	// language, or nil if unknown.
+	Completed *bool `json:"completed,omitempty"`
+	// Status is the MangaUpdates status of the series, such as
+	// "12 Volumes (Ongoing)".
+	Status string `json:"status,omitempty"`
+	// Publishers are the series' publishers of the requested types.
+	Publishers []publisher `json:"publishers,omitempty"`
+	// Covers are the paths of the cover files written for the series.
+	Covers []string `json:"covers,omitempty"`
+	// Reason explains why a title wasn't found or matched exactly.
+	Reason string `json:"reason,omitempty"`
+	// DerivedFrom is the input title this series is related to, if it
+	// wasn't in the input itself.
+	DerivedFrom string `json:"derived_from,omitempty"`
+	// Relation is how a derived series is related, such as Sequel.
+	Relation string `json:"relation,omitempty"`
+}
+
+var resultHeader = []string{
+	"title", "resolved_title", "series_id", "manga_id", "url",
+	"match", "confidence", "licensed", "completed", "status", "publishers", "canonical_publishers", "publisher_types", "publisher_notes",
+	"publisher_volumes", "publisher_release_status", "publisher_format",
+	"covers", "reason", "derived_from", "relation",
+}
+
+func (r result) row() []string {
+	var id string
+	if r.SeriesID > 0 {
+		id = strconv.FormatInt(r.SeriesID, 10)
+	}
+	var licensed, completed string
+	if r.Licensed != nil {
+		licensed = strconv.FormatBool(*r.Licensed)
+	}
+	if r.Completed != nil {
+		completed = strconv.FormatBool(*r.Completed)
+	}
+	var names, canonical, types, notes, volumes, statuses, formats []string
+	for _, p := range r.Publishers {
+		names = append(names, p.Name)
+		canonical = append(canonical, p.Canonical)
+		types = append(types, p.Type)
+		notes = append(notes, p.Notes)
+		var v string
+		if p.Volumes > 0 {
+			v = strconv.Itoa(p.Volumes)
+		}
+		volumes = append(volumes, v)
+		statuses = append(statuses, p.Status)
+		formats = append(formats, p.Format)
+	}
+	return []string{
+		r.Title, r.ResolvedTitle, id, r.MangaID, r.URL,
+		r.Match, strconv.FormatFloat(r.Confidence, 'f', 2, 64), licensed, completed, r.Status,
+		strings.Join(names, listSep), strings.Join(canonical, listSep),
+		strings.Join(types, listSep), strings.Join(notes, listSep),
+		strings.Join(volumes, listSep), strings.Join(statuses, listSep), strings.Join(formats, listSep),
+		strings.Join(r.Covers, listSep), r.Reason, r.DerivedFrom, r.Relation,
+	}
+}
+
+// parseResultRow parses a CSV row written by result.row back into a
+// result, looking up the columns by name in header.
+func parseResultRow(header, row []string) (result, error) {
+	var r result
+	if len(row) != len(header) {
+		return r, fmt.Errorf("expected row of length %d, got %d", len(header), len(row))
+	}
+
+	col := make(map[string]string, len(header))
+	for i, h := range header {
+		col[h] = row[i]
+	}
+
+	parseBool := func(name string) (*bool, error) {
+		if col[name] == "" {
+			return nil, nil
+		}
+		b, err := strconv.ParseBool(col[name])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", name, err)
+		}
+		return &b, nil
+	}
+
+	var err error
+	r.Title = col["title"]
+	r.ResolvedTitle = col["resolved_title"]
+	if col["series_id"] != "" {
+		r.SeriesID, err = strconv.ParseInt(col["series_id"], 10, 64)
+		if err != nil {
+			return r, fmt.Errorf("error parsing series_id: %w", err)
+		}
+	}
+	r.MangaID = col["manga_id"]
+	r.URL = col["url"]
+	r.Match = col["match"]
+	if col["confidence"] != "" {
+		r.Confidence, err = strconv.ParseFloat(col["confidence"], 64)
+		if err != nil {
+			return r, fmt.Errorf("error parsing confidence: %w", err)
+		}
+	}
+	r.Licensed, err = parseBool("licensed")
+	if err != nil {
+		return r, err
+	}
+	r.Completed, err = parseBool("completed")
+	if err != nil {
+		return r, err
+	}
+	r.Status = col["status"]
+
+	if col["publishers"] != "" {
+		names := strings.Split(col["publishers"], listSep)
+		n := len(names)
+		canonical := splitN(col["canonical_publishers"], n)
+		types := splitN(col["publisher_types"], n)
+		notes := splitN(col["publisher_notes"], n)
+		volumes := splitN(col["publisher_volumes"], n)
+		statuses := splitN(col["publisher_release_status"], n)
+		formats := splitN(col["publisher_format"], n)
+		for i, name := range names {
+			p := publisher{Name: name, Canonical: canonical[i], Type: types[i], Notes: notes[i]}
+			p.Volumes, _ = strconv.Atoi(volumes[i])
+			p.Status = statuses[i]
+			p.Format = formats[i]
+			r.Publishers = append(r.Publishers, p)
+		}
+	}
+
+	if col["covers"] != "" {
+		r.Covers = strings.Split(col["covers"], listSep)
+	}
+	r.Reason = col["reason"]
+	r.DerivedFrom = col["derived_from"]
+	r.Relation = col["relation"]
+
+	return r, nil
+}
+
+// splitN splits the list valued column s into exactly n elements, padding
+// with empty ones.
+func splitN(s string, n int) []string {
+	ret := make([]string, n)
+	if s == "" {
+		return ret
+	}
+	copy(ret, strings.Split(s, listSep))
+	return ret
+}
+
+// readResults reads results written in format back from r.
+func readResults(r io.Reader, format string) ([]result, error) {
+	var ret []result
+
+	switch format {
+	case formatCSV:
+		recs, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %w", err)
+		}
+		if len(recs) < 1 {
+			return nil, nil
+		}
+		for _, rec := range recs[1:] {
+			res, err := parseResultRow(recs[0], rec)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, res)
+		}
+	case formatJSON:
+		err := json.NewDecoder(r).Decode(&ret)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding JSON: %w", err)
+		}
+	case formatNDJSON:
+		dec := json.NewDecoder(r)
+		for {
+			var res result
+			err := dec.Decode(&res)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error decoding JSON: %w", err)
+			}
+			ret = append(ret, res)
+		}
+	default:
+		return nil, checkFormat(format)
+	}
+
+	return ret, nil
+}
+
+// formatOf guesses the output format of the file at path from its
+// extension, defaulting to CSV.
+func formatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return formatJSON
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	}
+	return formatCSV
+}
+
+// matchResult sets the match fields of r from the resolved title.
+func (r *result) matchResult(resolved string) {
+	r.ResolvedTitle = resolved
+	r.Confidence = similarity(r.Title, resolved)
+	r.Match = matchExact
+	if resolved != r.Title {
+		r.Match = matchInexact
+		r.Reason = "exact match not found"
+	}
+}
+
+// csvRecord is implemented by records that can be written as a CSV row.
+// Records are written as JSON with encoding/json.
+type csvRecord interface {
+	row() []string
+}
+
+// recordWriter writes records in one of the output formats.
+type recordWriter[T csvRecord] interface {
+	Write(rec T) error
+	// Close flushes any buffered output and closes the underlying writer.
+	Close() error
+}
+
+const groupByPublisher = "publisher"
+
+func checkGroupBy(groupBy string) error {
+	switch groupBy {
+	case "", groupByPublisher:
+		return nil
+	}
+	return fmt.Errorf("unknown grouping %q, expected publisher", groupBy)
+}
+
+const (
+	groupPublisher   = "publisher"
+	groupUnlicensed  = "unlicensed"
+	groupNoPublisher = "no_publisher"
+	groupInexact     = "inexact"
+)
+
+// publisherGroup is a row of the per-publisher report: the titles held by
+// a single publisher, the titles that aren't licensed in English, the
+// licensed titles without any publisher of the chosen types, or the titles
+// only matched inexactly.
+type publisherGroup struct {
+	// Kind is publisher, unlicensed, no_publisher or inexact.
+	Kind      string   `json:"kind"`
+	Publisher string   `json:"publisher,omitempty"`
+	Count     int      `json:"count"`
+	Titles    []string `json:"titles"`
+}
+
+var publisherGroupHeader = []string{"kind", "publisher", "count", "titles"}
+
+func (pg publisherGroup) row() []string {
+	return []string{pg.Kind, pg.Publisher, strconv.Itoa(pg.Count), strings.Join(pg.Titles, listSep)}
+}
+
+// groupByPublishers lists the titles of results under each of their
+// canonical publishers, ordered by descending count, followed by the
+// titles not licensed in English, the licensed titles without any of the
+// publishers, and the inexactly matched titles, whose publishers may well
+// be those of another series. Unlicensed titles are still listed under
+// their publishers of other types, such as the original one. Titles that
+// weren't found are left out.
+func groupByPublishers(results []result) []publisherGroup {
+	byName := make(map[string]*publisherGroup)
+	var groups []*publisherGroup
+	unlicensed := publisherGroup{Kind: groupUnlicensed, Titles: []string{}}
+	noPublisher := publisherGroup{Kind: groupNoPublisher, Titles: []string{}}
+	inexact := publisherGroup{Kind: groupInexact, Titles: []string{}}
+
+	for _, r := range results {
+		if r.Match == matchNone {
+			continue
+		}
+		if r.Match == matchInexact {
+			inexact.Titles = append(inexact.Titles, r.Title)
+			continue
+		}
+		if !licensedInEnglish(r) {
+			unlicensed.Titles = append(unlicensed.Titles, r.Title)
+		} else if len(r.Publishers) < 1 {
+			noPublisher.Titles = append(noPublisher.Titles, r.Title)
+		}
+
+		seen := make(map[string]bool)
+		for _, p := range r.Publishers {
+			if seen[p.Canonical] {
+				continue
+			}
+			seen[p.Canonical] = true
+
+			pg, ok := byName[p.Canonical]
+			if !ok {
+				pg = &publisherGroup{Kind: groupPublisher, Publisher: p.Canonical}
+				byName[p.Canonical] = pg
+				groups = append(groups, pg)
+			}
+			pg.Titles = append(pg.Titles, r.Title)
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if len(groups[i].Titles) != len(groups[j].Titles) {
+			return len(groups[i].Titles) > len(groups[j].Titles)
+		}
+		return groups[i].Publisher < groups[j].Publisher
+	})
+
+	ret := make([]publisherGroup, 0, len(groups)+3)
+	for _, pg := range groups {
+		pg.Count = len(pg.Titles)
+		ret = append(ret, *pg)
+	}
+	for _, pg := range []*publisherGroup{&unlicensed, &noPublisher, &inexact} {
+		pg.Count = len(pg.Titles)
+		ret = append(ret, *pg)
+	}
+
+	return ret
+}
+
+// licensedInEnglish reports whether the title of r is licensed in English,
+// by the MangaUpdates flag or, for outputs without it, by having an
+// English publisher.
+func licensedInEnglish(r result) bool {
+	if r.Licensed != nil {
+		return *r.Licensed
+	}
+	for _, p := range r.Publishers {
+		if strings.EqualFold(p.Type, "English") {
+			return true
+		}
+	}
+	return false
+}
+
+// groupingWriter collects results and writes them grouped by publisher
+// when closed.
+type groupingWriter struct {
+	results []result
+	w       recordWriter[publisherGroup]
+}
+
+func (gw *groupingWriter) Write(r result) error {
+	gw.results = append(gw.results, r)
+	return nil
+}
+
+func (gw *groupingWriter) Close() error {
+	for _, pg := range groupByPublishers(gw.results) {
+		err := gw.w.Write(pg)
+		if err != nil {
+			gw.w.Close()
+			return err
+		}
+	}
+	return gw.w.Close()
+}
+
+func writeResults(rw recordWriter[result], results []result) error {
+	for _, r := range results {
+		err := rw.Write(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case formatCSV, formatJSON, formatNDJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, expected csv, json or ndjson", format)
+}
+
+// newResultWriter returns a writer of results to w in format, grouped
+// according to groupBy.
+func newResultWriter(w io.WriteCloser, format, groupBy string) (recordWriter[result], error) {
+	if groupBy == groupByPublisher {
+		pw, err := newRecordWriter[publisherGroup](w, format, publisherGroupHeader)
+		if err != nil {
+			return nil, err
+		}
+		return &groupingWriter{w: pw}, nil
+	}
+	return newRecordWriter[result](w, format, resultHeader)
+}
+
+// newRecordWriter returns a writer of records to w in format. The header
+// is only written for CSV.
+func newRecordWriter[T csvRecord](w io.WriteCloser, format string, header []string) (recordWriter[T], error) {
+	switch format {
+	case formatCSV:
+		cw := &csvRecordWriter[T]{w: w, csvw: csv.NewWriter(w)}
+		err := cw.csvw.Write(header)
+		if err != nil {
+			return nil, fmt.Errorf("error writing header: %w", err)
+		}
+		return cw, nil
+	case formatJSON:
+		return &jsonRecordWriter[T]{w: w}, nil
+	case formatNDJSON:
+		return &ndjsonRecordWriter[T]{w: w, enc: json.NewEncoder(w)}, nil
+	}
+	return nil, checkFormat(format)
+}
+
+type csvRecordWriter[T csvRecord] struct {
+	w    io.WriteCloser
+	csvw *csv.Writer
+}
+
+// Write writes and flushes a row, so that rows written so far survive
+// an interrupted run.
+func (cw *csvRecordWriter[T]) Write(rec T) error {
+	err := cw.csvw.Write(rec.row())
+	if err != nil {
+		return fmt.Errorf("error writing CSV row: %w", err)
+	}
+	cw.csvw.Flush()
+	err = cw.csvw.Error()
+	if err != nil {
+		return fmt.Errorf("error flushing csv writer: %w", err)
+	}
+	return nil
+}
+
+func (cw *csvRecordWriter[T]) Close() error {
+	defer cw.w.Close()
+
+	cw.csvw.Flush()
+	err := cw.csvw.Error()
+	if err != nil {
+		return fmt.Errorf("error flushing csv writer: %w", err)
+	}
+	return nil
+}
+
+// jsonRecordWriter writes a single JSON array of records.
+type jsonRecordWriter[T csvRecord] struct {
+	w io.WriteCloser
+	n int
+}
+
+func (jw *jsonRecordWriter[T]) Write(rec T) error {
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error marshalling record: %w", err)
+	}
+
+	sep := ",\n"
+	if jw.n == 0 {
+		sep = "[\n"
+	}
+	jw.n++
+
+	_, err = io.WriteString(jw.w, sep+string(bs))
+	if err != nil {
+		return fmt.Errorf("error writing JSON: %w", err)
+	}
+	return nil
+}
+
+func (jw *jsonRecordWriter[T]) Close() error {
+	defer jw.w.Close()
+
+	end := "\n]\n"
+	if jw.n == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(jw.w, end)
+	if err != nil {
+		return fmt.Errorf("error writing JSON: %w", err)
+	}
+	return nil
+}
+
+// ndjsonRecordWriter writes one JSON object per line.
+type ndjsonRecordWriter[T csvRecord] struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func (nw *ndjsonRecordWriter[T]) Write(rec T) error {
+	err := nw.enc.Encode(rec)
+	if err != nil {
+		return fmt.Errorf("error writing JSON: %w", err)
+	}
+	return nil
+}
+
+func (nw *ndjsonRecordWriter[T]) Close() error {
+	return nw.w.Close()
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -21,38 +25,51 @@ func get[T any](url string) (T, error) {
 	if err != nil {
 		return zero, fmt.Errorf("error getting: %w", err)
 	}
-	defer resp.Body.Close()
 
-	bs, err := io.ReadAll(resp.Body)
+	return decodeResp[T](resp)
+}
+
+func post[T any](url string, v url.Values) (T, error) {
+	var zero T
+	resp, err := c.PostForm(url, v)
 	if err != nil {
-		return zero, fmt.Errorf("error reading all from response: %w", err)
+		return zero, fmt.Errorf("error posting: %w", err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return zero, fmt.Errorf("did not get HTTP 200, got HTTP %d with body %s", resp.StatusCode, string(bs))
+	return decodeResp[T](resp)
+}
+
+// postJSON is post for endpoints that take a JSON body.
+func postJSON[T any](url string, body any) (T, error) {
+	var zero T
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return zero, fmt.Errorf("error marshalling JSON HTTP request: %w", err)
 	}
 
-	var ret T
-	err = json.Unmarshal(bs, &ret)
+	resp, err := c.Post(url, "application/json", bytes.NewReader(bs))
 	if err != nil {
-		return zero, fmt.Errorf("error unmarshalling JSON HTTP response: %w", err)
+		return zero, fmt.Errorf("error posting: %w", err)
 	}
 
-	return ret, nil
+	return decodeResp[T](resp)
 }
 
-func post[T any](url string, v url.Values) (T, error) {
+// decodeResp closes resp after decoding its JSON body, which must come
+// with HTTP 200.
+func decodeResp[T any](resp *http.Response) (T, error) {
 	var zero T
-	resp, err := c.PostForm(url, v)
-	if err != nil {
-		return zero, fmt.Errorf("error posting: %w", err)
-	}
 	defer resp.Body.Close()
+
 	bs, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return zero, fmt.Errorf("error reading all from response: %w", err)
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return zero, fmt.Errorf("did not get HTTP 200, got HTTP %d with body %s", resp.StatusCode, string(bs))
+	}
+
 	var ret T
 	err = json.Unmarshal(bs, &ret)
 	if err != nil {
@@ -61,3 +78,103 @@ func post[T any](url string, v url.Values) (T, error) {
 
 	return ret, nil
 }
+
+// similarity returns how alike a and b are, ignoring case, as a number
+// between 0 and 1 derived from their edit distance.
+func similarity(a, b string) float64 {
+	ra := []rune(strings.ToLower(a))
+	rb := []rune(strings.ToLower(b))
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// splitList splits the comma separated list s, dropping empty elements.
+func splitList(s string) []string {
+	var ret []string
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// logSummary logs how many of total titles were processed, listing the
+// skipped ones that weren't.
+func logSummary(total int, skipped []string) {
+	log.Printf("processed %d of %d titles", total-len(skipped), total)
+	if len(skipped) > 0 {
+		log.Printf("not processed: %s", strings.Join(skipped, listSep))
+	}
+}
+
+// defaultMuRate is the default max requests per second to MangaUpdates.
+const defaultMuRate = 0.4
+
+// limiter spaces out events to a steady rate, shared between goroutines.
+// A nil *limiter doesn't limit.
+type limiter struct {
+	ticker *time.Ticker
+}
+
+// newLimiter returns a limiter allowing rate events per second. Rates
+// beyond one event per nanosecond are treated as exactly that.
+func newLimiter(rate float64) *limiter {
+	d := time.Duration(float64(time.Second) / rate)
+	if d < 1 {
+		d = 1
+	}
+	return &limiter{ticker: time.NewTicker(d)}
+}
+
+// wait blocks until the next event is allowed or ctx is canceled.
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.ticker.C:
+		return nil
+	}
+}
+
+func (l *limiter) stop() {
+	if l != nil {
+		l.ticker.Stop()
+	}
+}